@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 
@@ -30,6 +36,11 @@ func initHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := galaxy.ValidateReplicationModes(req.Shards); err != nil {
+		http.Error(w, fmt.Sprintf("Error in shard configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	schemaConfig = req.Schema
 
 	for rawServerName, shardIDs := range req.Servers {
@@ -67,7 +78,7 @@ func initHandler(w http.ResponseWriter, r *http.Request) {
 	var shardIDs []string
 
 	for _, shard := range req.Shards {
-		_, err := db.Exec("INSERT INTO shardt (stud_id_low, shard_id, shard_size, valid_idx) VALUES ($1, $2, $3, $4);", shard.StudIDLow, shard.ShardID, shard.ShardSize, 0)
+		_, err := db.Exec("INSERT INTO shardt (stud_id_low, shard_id, shard_size, valid_idx, replication_mode) VALUES ($1, $2, $3, $4, $5);", shard.StudIDLow, shard.ShardID, shard.ShardSize, 0, shard.ReplicationMode)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error creating shardt entry: %v", err), http.StatusInternalServerError)
 			return
@@ -146,7 +157,7 @@ func statusHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 
 	shards := []galaxy.Shard{}
-	rows, err := db.Query("SELECT stud_id_low, shard_id, shard_size FROM shardt;")
+	rows, err := db.Query("SELECT stud_id_low, shard_id, shard_size, replication_mode FROM shardt;")
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting shardt entry: %v", err), http.StatusInternalServerError)
 		return
@@ -155,7 +166,7 @@ func statusHandler(w http.ResponseWriter, _ *http.Request) {
 
 	for rows.Next() {
 		var shard galaxy.Shard
-		err = rows.Scan(&shard.StudIDLow, &shard.ShardID, &shard.ShardSize)
+		err = rows.Scan(&shard.StudIDLow, &shard.ShardID, &shard.ShardSize, &shard.ReplicationMode)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error scanning row: %v", err), http.StatusInternalServerError)
 			return
@@ -193,6 +204,11 @@ func addServersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := galaxy.ValidateReplicationModes(req.NewShards); err != nil {
+		http.Error(w, fmt.Sprintf("Error in shard configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	serverIDsAdded := []int{}
 
 	for rawServerName, shardIDs := range req.Servers {
@@ -231,7 +247,7 @@ func addServersHandler(w http.ResponseWriter, r *http.Request) {
 	var shardIDs []string
 
 	for _, shard := range req.NewShards {
-		_, err := db.Exec("INSERT INTO shardt (stud_id_low, shard_id, shard_size, valid_idx) VALUES ($1, $2, $3, $4);", shard.StudIDLow, shard.ShardID, shard.ShardSize, 0)
+		_, err := db.Exec("INSERT INTO shardt (stud_id_low, shard_id, shard_size, valid_idx, replication_mode) VALUES ($1, $2, $3, $4, $5);", shard.StudIDLow, shard.ShardID, shard.ShardSize, 0, shard.ReplicationMode)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error creating shardt entry: %v", err), http.StatusInternalServerError)
 			return
@@ -434,6 +450,19 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	switch req.Consistency {
+	case "":
+		req.Consistency = galaxy.DEFAULT_READ_CONSISTENCY
+	case galaxy.READ_CONSISTENCY_PRIMARY, galaxy.READ_CONSISTENCY_QUORUM, galaxy.READ_CONSISTENCY_ANY:
+	default:
+		http.Error(w, fmt.Sprintf("Unknown read consistency %q", req.Consistency), http.StatusBadRequest)
+		return
+	}
+	positions, err := galaxy.ParseChangeToken(req.Token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing session token: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	shardIDsQueried := []string{}
 	rows, err := db.Query("SELECT shard_id FROM shardt WHERE (stud_id_low BETWEEN $1 AND $2) OR (stud_id_low+shard_size BETWEEN $1 AND $2);", req.StudID.Low, req.StudID.High)
@@ -458,31 +487,24 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 		payload := galaxy.ServerReadPayload{
 			Shard:  shardIDQueried,
 			StudID: req.StudID,
+			MinLSN: positions[shardIDQueried],
 		}
-		payloadData, err := json.Marshal(payload)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		serverID := shardTConfigs[shardIDQueried].CHM.GetServerForRequest(galaxy.GetRandomID())
 
-		resp, err := http.Post("http://"+galaxy.GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(galaxy.SERVER_PORT)+"/read", "application/json", bytes.NewBuffer(payloadData))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading from server: %v", err), http.StatusInternalServerError)
-			return
+		var respData galaxy.ServerReadResponse
+		switch req.Consistency {
+		case galaxy.READ_CONSISTENCY_PRIMARY:
+			respData, err = galaxy.ReadFromPrimary(db, payload)
+		case galaxy.READ_CONSISTENCY_QUORUM:
+			respData, err = galaxy.ReadFromQuorum(db, payload)
+		default:
+			serverID := shardTConfigs[shardIDQueried].CHM.GetServerForRequest(galaxy.GetRandomID())
+			respData, err = galaxy.ReadAtLeast(db, serverID, payload)
 		}
-
-		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading response body: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error reading from server: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		var respData galaxy.ServerReadResponse
-		json.Unmarshal(body, &respData)
-		resp.Body.Close()
-
 		studData = append(studData, respData.Data...)
 	}
 
@@ -508,6 +530,11 @@ func WriteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	positions, err := galaxy.ParseChangeToken(req.Token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing session token: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	studDataToWrite := map[string][]galaxy.StudT{}
 	for _, studData := range req.Data {
@@ -519,48 +546,54 @@ func WriteHandler(w http.ResponseWriter, r *http.Request) {
 		studDataToWrite[shardID] = append(studDataToWrite[shardID], studData)
 	}
 
-	for shardID, studData := range studDataToWrite {
-		shardTConfigs[shardID].Mutex.Lock()
-
-		payload := galaxy.ServerWritePayload{
-			Shard: shardID,
-			Data:  studData,
+	if req.Atomic {
+		shardOps := make(map[string][]galaxy.ServerTxnOp)
+		for shardID, studData := range studDataToWrite {
+			shardOps[shardID] = []galaxy.ServerTxnOp{{Op: galaxy.TXN_OP_WRITE, Data: studData}}
 		}
-		payloadData, err := json.Marshal(payload)
+
+		txID, commits, err := runTransaction(shardOps, r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error writing records atomically: %v", err), http.StatusInternalServerError)
 			return
 		}
+		for shardID, lsn := range commits {
+			positions[shardID] = max(positions[shardID], lsn)
+		}
 
-		serverIDs, err := galaxy.GetServerIDsForShard(db, shardID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error getting server IDs for shard: %v", err), http.StatusInternalServerError)
-			return
+		response := galaxy.WriteResponse{
+			Status:  "success",
+			Message: fmt.Sprintf("%d Data entries added", len(req.Data)),
+			TxID:    txID,
+			Token:   galaxy.FormatChangeToken(positions),
 		}
-		for _, serverID := range serverIDs {
-			resp, err := http.Post("http://"+galaxy.GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(galaxy.SERVER_PORT)+"/write", "application/json", bytes.NewBuffer(payloadData))
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error writing %s record to Server%d: %v", shardID, serverID, err), http.StatusInternalServerError)
-				return
-			}
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error reading response body from Server%d: %v", serverID, err), http.StatusInternalServerError)
-				return
-			}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
-			var respData galaxy.ServerWriteResponse
-			json.Unmarshal(body, &respData)
-			resp.Body.Close()
+	for shardID, studData := range studDataToWrite {
+		payload := galaxy.ServerWritePayload{
+			Shard: shardID,
+			Data:  studData,
 		}
 
+		shardTConfigs[shardID].Mutex.Lock()
+		lsn, err := galaxy.SendToPrimary(db, shardID, "POST", "/write", payload, r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER))
 		shardTConfigs[shardID].Mutex.Unlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error writing %s records: %v", shardID, err), http.StatusInternalServerError)
+			return
+		}
+		positions[shardID] = max(positions[shardID], lsn)
 	}
 
 	response := galaxy.WriteResponse{
 		Status:  "success",
 		Message: fmt.Sprintf("%d Data entries added", len(req.Data)),
+		Token:   galaxy.FormatChangeToken(positions),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -579,48 +612,34 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	positions, err := galaxy.ParseChangeToken(req.Token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing session token: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	shardID, err := galaxy.GetShardIDFromStudID(db, req.StudID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting shard ID: %v", err), http.StatusInternalServerError)
 		return
 	}
-	shardTConfigs[shardID].Mutex.Lock()
-
 	payload := galaxy.ServerUpdatePayload{
 		Shard:  shardID,
 		StudID: req.StudID,
 		Data:   req.Data,
 	}
 
-	payloadData, err := json.Marshal(payload)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	serverIDs, err := galaxy.GetServerIDsForShard(db, shardID)
+	shardTConfigs[shardID].Mutex.Lock()
+	lsn, err := galaxy.SendToPrimary(db, shardID, "PUT", "/update", payload, r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER))
+	shardTConfigs[shardID].Mutex.Unlock()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting server IDs for shard: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error updating Stud_id %d: %v", req.StudID, err), http.StatusInternalServerError)
 		return
 	}
-	for _, serverID := range serverIDs {
-		req, err := http.NewRequest("PUT", "http://"+galaxy.GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(galaxy.SERVER_PORT)+"/update", bytes.NewBuffer(payloadData))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error creating server request: %v", err), http.StatusInternalServerError)
-			return
-		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error updating server: %v", err), http.StatusInternalServerError)
-			return
-		}
-		resp.Body.Close()
-	}
-	shardTConfigs[shardID].Mutex.Unlock()
+	positions[shardID] = max(positions[shardID], lsn)
 
 	response := galaxy.UpdateResponse{
+		Token:   galaxy.FormatChangeToken(positions),
 		Status:  "success",
 		Message: fmt.Sprintf("Data entry for Stud_id: %d updated", req.StudID),
 	}
@@ -641,48 +660,115 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	positions, err := galaxy.ParseChangeToken(req.Token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing session token: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	shardID, err := galaxy.GetShardIDFromStudID(db, req.StudID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting shard ID: %v", err), http.StatusInternalServerError)
 		return
 	}
-	shardTConfigs[shardID].Mutex.Lock()
-
 	payload := galaxy.ServerDeletePayload{
 		Shard:  shardID,
 		StudID: req.StudID,
 	}
-	payloadData, err := json.Marshal(payload)
+
+	shardTConfigs[shardID].Mutex.Lock()
+	lsn, err := galaxy.SendToPrimary(db, shardID, "DELETE", "/delete", payload, r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER))
+	shardTConfigs[shardID].Mutex.Unlock()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error deleting Stud_id %d: %v", req.StudID, err), http.StatusInternalServerError)
 		return
 	}
+	positions[shardID] = max(positions[shardID], lsn)
 
-	serverIDs, err := galaxy.GetServerIDsForShard(db, shardID)
+	response := galaxy.DeleteResponse{
+		Message: fmt.Sprintf("Data entry with Stud_id: %d removed from all replicas", req.StudID),
+		Token:   galaxy.FormatChangeToken(positions),
+		Status:  "success",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// transactionHandler makes a list of writes, updates and deletes as one
+// transaction across every shard they touch.
+func transactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req galaxy.TransactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	positions, err := galaxy.ParseChangeToken(req.Token)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting server IDs for shard: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error parsing session token: %v", err), http.StatusBadRequest)
 		return
 	}
-	for _, serverID := range serverIDs {
-		req, err := http.NewRequest("DELETE", "http://"+galaxy.GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(galaxy.SERVER_PORT)+"/delete", bytes.NewBuffer(payloadData))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error creating server request: %v", err), http.StatusInternalServerError)
-			return
-		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error deleting from server: %v", err), http.StatusInternalServerError)
+	if len(req.Ops) == 0 {
+		http.Error(w, "Transaction has no operations", http.StatusBadRequest)
+		return
+	}
+
+	shardOps := make(map[string][]galaxy.ServerTxnOp)
+	for i, op := range req.Ops {
+		switch op.Op {
+		case galaxy.TXN_OP_WRITE:
+			if len(op.Data) == 0 {
+				http.Error(w, fmt.Sprintf("Operation %d writes no data", i), http.StatusBadRequest)
+				return
+			}
+			studDataToWrite := map[string][]galaxy.StudT{}
+			for _, studData := range op.Data {
+				shardID, err := galaxy.GetShardIDFromStudID(db, studData.StudID)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error getting shard ID: %v", err), http.StatusInternalServerError)
+					return
+				}
+				studDataToWrite[shardID] = append(studDataToWrite[shardID], studData)
+			}
+			for shardID, studData := range studDataToWrite {
+				shardOps[shardID] = append(shardOps[shardID], galaxy.ServerTxnOp{Op: op.Op, Data: studData})
+			}
+		case galaxy.TXN_OP_UPDATE, galaxy.TXN_OP_DELETE:
+			if op.Op == galaxy.TXN_OP_UPDATE && len(op.Data) != 1 {
+				http.Error(w, fmt.Sprintf("Operation %d must update Stud_id %d to exactly one row", i, op.StudID), http.StatusBadRequest)
+				return
+			}
+			shardID, err := galaxy.GetShardIDFromStudID(db, op.StudID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error getting shard ID: %v", err), http.StatusInternalServerError)
+				return
+			}
+			shardOps[shardID] = append(shardOps[shardID], galaxy.ServerTxnOp{Op: op.Op, StudID: op.StudID, Data: op.Data})
+		default:
+			http.Error(w, fmt.Sprintf("Unknown operation %q", op.Op), http.StatusBadRequest)
 			return
 		}
-		resp.Body.Close()
 	}
 
-	shardTConfigs[shardID].Mutex.Unlock()
+	txID, commits, err := runTransaction(shardOps, r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error running transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for shardID, lsn := range commits {
+		positions[shardID] = max(positions[shardID], lsn)
+	}
 
-	response := galaxy.DeleteResponse{
-		Message: fmt.Sprintf("Data entry with Stud_id: %d removed from all replicas", req.StudID),
+	response := galaxy.TransactionResponse{
+		Message: fmt.Sprintf("Transaction of %d operations committed", len(req.Ops)),
+		TxID:    txID,
+		Token:   galaxy.FormatChangeToken(positions),
 		Status:  "success",
 	}
 
@@ -691,6 +777,98 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// runTransaction runs a transaction while holding the mutex of each of its
+// shards, taken in order so that concurrent transactions cannot deadlock.
+func runTransaction(shardOps map[string][]galaxy.ServerTxnOp, key string) (string, map[string]int64, error) {
+	shardIDs := make([]string, 0, len(shardOps))
+	for shardID := range shardOps {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+
+	for _, shardID := range shardIDs {
+		shardTConfigs[shardID].Mutex.Lock()
+		defer shardTConfigs[shardID].Mutex.Unlock()
+	}
+	return galaxy.RunTransaction(db, shardOps, key)
+}
+
+// idempotent makes the mutations of handler that carry an Idempotency-Key
+// header once per key. Retries of a mutation that succeeded are answered with
+// its original response, while retries of one that failed are made again.
+// Reusing a key for a different request is refused.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(galaxy.IDEMPOTENCY_KEY_HEADER)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > galaxy.MAX_IDEMPOTENCY_KEY_LENGTH {
+			http.Error(w, fmt.Sprintf("%s is longer than %d bytes", galaxy.IDEMPOTENCY_KEY_HEADER, galaxy.MAX_IDEMPOTENCY_KEY_LENGTH), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+
+		outcome, reserved, err := galaxy.ReserveIdempotencyKey(db, key, requestHash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reserving idempotency key: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			switch {
+			case outcome.RequestHash != requestHash:
+				http.Error(w, fmt.Sprintf("Idempotency key %q was used for a different request", key), http.StatusUnprocessableEntity)
+			case outcome.StatusCode == 0:
+				http.Error(w, fmt.Sprintf("A request with idempotency key %q is in progress", key), http.StatusConflict)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(galaxy.IDEMPOTENT_REPLAYED_HEADER, "true")
+				w.WriteHeader(outcome.StatusCode)
+				w.Write(outcome.Response)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(recorder, r)
+
+		if recorder.statusCode >= 200 && recorder.statusCode < 300 {
+			err = galaxy.StoreIdempotentOutcome(db, key, recorder.statusCode, recorder.body.Bytes())
+		} else {
+			err = galaxy.ReleaseIdempotencyKey(db, key)
+		}
+		if err != nil {
+			log.Printf("Error recording outcome of idempotency key %q: %v\n", key, err)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	recorder.body.Write(data)
+	return recorder.ResponseWriter.Write(data)
+}
+
 func serverIDsHandler(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -714,6 +892,214 @@ func replaceServerHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// restoreHandler restores a shard to its state at a given LSN or timestamp,
+// either into a new shard on the server it is restored from or into a fresh
+// server. Neither is added to the ring; they are meant for inspection.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req galaxy.RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.LSN <= 0 && req.Timestamp == "" {
+		http.Error(w, "Either lsn or timestamp is required", http.StatusBadRequest)
+		return
+	}
+	if (req.NewShard == "") == (req.Server == "") {
+		http.Error(w, "Exactly one of new_shard and server is required", http.StatusBadRequest)
+		return
+	}
+
+	sourceServerID, err := galaxy.GetPrimaryServerIDForShard(db, req.Shard)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting primary server: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if sourceServerID == -1 {
+		shardServerIDs, err := galaxy.GetServerIDsForShard(db, req.Shard)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting server IDs for shard: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(shardServerIDs) == 0 {
+			http.Error(w, fmt.Sprintf("No servers found for shard %s", req.Shard), http.StatusNotFound)
+			return
+		}
+		sourceServerID = shardServerIDs[0]
+	}
+
+	var resp galaxy.RestoreResponse
+	if req.NewShard != "" {
+		payload := galaxy.ServerRestorePayload{
+			Shard:       req.Shard,
+			TargetShard: req.NewShard,
+			LSN:         req.LSN,
+			Timestamp:   req.Timestamp,
+		}
+		restored, err := galaxy.RestoreShardOnServer(sourceServerID, payload)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error restoring shard: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		resp = galaxy.RestoreResponse{
+			Message: fmt.Sprintf("Shard %s restored into %s on Server%d at LSN %d", req.Shard, req.NewShard, sourceServerID, restored.LSN),
+			Server:  fmt.Sprintf("Server%d", sourceServerID),
+			Shard:   req.NewShard,
+			LSN:     restored.LSN,
+			Status:  "success",
+		}
+	} else {
+		snapshot, err := galaxy.GetServerPointInTime(sourceServerID, req.Shard, req.LSN, req.Timestamp)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error restoring shard: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		serverID := galaxy.GetServerID(req.Server)
+		err = galaxy.SpawnNewServerInstance(fmt.Sprintf("Server%d", serverID), serverID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error spawning new server: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// The server holds a copy of a shard that is still in use, which
+		// must not join the shard's Raft group.
+		err = galaxy.ConfigStandaloneServerInstance(serverID, []string{req.Shard})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error configuring new server: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		err = galaxy.LoadServerSnapshot(serverID, snapshot)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error restoring shard: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		resp = galaxy.RestoreResponse{
+			Message: fmt.Sprintf("Shard %s restored on Server%d at LSN %d", req.Shard, serverID, snapshot.LSN),
+			Server:  fmt.Sprintf("Server%d", serverID),
+			Shard:   req.Shard,
+			LSN:     snapshot.LSN,
+			Status:  "success",
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// changesHandler streams row changes as Server-Sent Events, merged from the
+// change feeds of every shard that overlaps the requested Stud_id range, or
+// of a single shard. Every event's id is a token holding the position of
+// each shard, so a client resumes by passing the last id it saw as token or
+// Last-Event-ID.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("Last-Event-ID")
+	}
+	positions, err := galaxy.ParseChangeToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	low := r.URL.Query().Get("low")
+	high := r.URL.Query().Get("high")
+	shardIDs := []string{}
+	if shardID := r.URL.Query().Get("shard"); shardID != "" {
+		shardIDs = append(shardIDs, shardID)
+	} else {
+		lowID, highID := math.MinInt32, math.MaxInt32
+		if low != "" {
+			lowID, err = strconv.Atoi(low)
+			if err != nil {
+				http.Error(w, "Invalid low", http.StatusBadRequest)
+				return
+			}
+		}
+		if high != "" {
+			highID, err = strconv.Atoi(high)
+			if err != nil {
+				http.Error(w, "Invalid high", http.StatusBadRequest)
+				return
+			}
+		}
+
+		rows, err := db.Query("SELECT shard_id FROM shardt WHERE stud_id_low <= $2 AND stud_id_low+shard_size >= $1;", lowID, highID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting shardt entry: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var shardID string
+			err = rows.Scan(&shardID)
+			if err != nil {
+				rows.Close()
+				http.Error(w, fmt.Sprintf("Error scanning rows: %v", err), http.StatusInternalServerError)
+				return
+			}
+			shardIDs = append(shardIDs, shardID)
+		}
+		rows.Close()
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan galaxy.ShardChangeEvent)
+	for _, shardID := range shardIDs {
+		from, ok := positions[shardID]
+		if !ok {
+			from = -1
+		}
+		go galaxy.FollowShardChanges(r.Context(), db, shardID, from, low, high, events)
+	}
+
+	keepalive := time.NewTicker(galaxy.CHANGE_FEED_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-events:
+			if event.Event == "error" {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", event.Data)
+				flusher.Flush()
+				return
+			}
+			positions[event.Shard] = event.Position
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", galaxy.FormatChangeToken(positions), event.Event, event.Data)
+		}
+		flusher.Flush()
+	}
+}
+
 func main() {
 	galaxy.BuildServerInstance()
 
@@ -731,16 +1117,22 @@ func main() {
 
 	shardTConfigs = make(map[string]galaxy.ShardTConfig)
 
+	go galaxy.ResolveTransactionsPeriodically(db)
+	go galaxy.ExpireIdempotencyKeysPeriodically(db)
+
 	http.HandleFunc("/init", initHandler)
 	http.HandleFunc("/status", statusHandler)
 	http.HandleFunc("/add", addServersHandler)
 	http.HandleFunc("/rm", removeServersHandler)
 	http.HandleFunc("/read", readHandler)
-	http.HandleFunc("/write", WriteHandler)
-	http.HandleFunc("/update", updateHandler)
-	http.HandleFunc("/del", deleteHandler)
+	http.HandleFunc("/write", idempotent(WriteHandler))
+	http.HandleFunc("/update", idempotent(updateHandler))
+	http.HandleFunc("/del", idempotent(deleteHandler))
+	http.HandleFunc("/transaction", idempotent(transactionHandler))
 	http.HandleFunc("/serverids", serverIDsHandler)
 	http.HandleFunc("/replace_server", replaceServerHandler)
+	http.HandleFunc("/restore", restoreHandler)
+	http.HandleFunc("/changes", changesHandler)
 
 	server := &http.Server{Addr: ":5000", Handler: nil}
 
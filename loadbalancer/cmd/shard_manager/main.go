@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,6 +23,10 @@ import (
 var (
 	db         *sql.DB
 	serverDown chan int
+
+	// leaderMutex serializes the recording of leaders, so that the epoch
+	// of a shard is checked and raised in one step.
+	leaderMutex sync.Mutex
 )
 
 func getServerIDs() []int {
@@ -152,16 +157,24 @@ func shardServersHandler(w http.ResponseWriter, r *http.Request) {
 		servers = append(servers, server)
 	}
 
-	var primary int
+	primary := -1
 	err = db.QueryRow("SELECT server_id FROM MapT WHERE shard_id = $1 and is_primary = TRUE;", req.ShardID).Scan(&primary)
-	if err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		http.Error(w, fmt.Sprintf("Error running sql query to get a primary server: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	var replicationMode string
+	err = db.QueryRow("SELECT replication_mode FROM ShardT WHERE shard_id = $1;", req.ShardID).Scan(&replicationMode)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error running sql query to get the replication mode of a shard: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	response := galaxy.ShardServersResponse{
-		ServerIDs: servers,
-		Primary:   primary,
+		ServerIDs:       servers,
+		Primary:         primary,
+		ReplicationMode: replicationMode,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -169,6 +182,66 @@ func shardServersHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// recordLeader marks server as the primary of shard and stores term as the
+// shard's epoch, unless a primary of a later epoch was already recorded. The
+// epoch goes to every replica row of the shard, so that it survives the
+// replacement of any of them.
+func recordLeader(shard string, server int, term int64) (bool, error) {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+
+	var epoch int64
+	err := db.QueryRow("SELECT COALESCE(MAX(epoch), 0) FROM MapT WHERE shard_id = $1;", shard).Scan(&epoch)
+	if err != nil {
+		return false, err
+	}
+	if term < epoch {
+		return false, nil
+	}
+
+	_, err = db.Exec("UPDATE MapT SET is_primary = (server_id = $2), epoch = $3 WHERE shard_id = $1;", shard, server, term)
+	if err != nil {
+		return false, err
+	}
+	if term > epoch {
+		log.Println("Server", server, "is the primary of", shard, "in epoch", term)
+	}
+	return true, nil
+}
+
+// leaderHandler records the leader a shard's Raft group elected as its
+// primary, with the term it was elected in as the shard's epoch. Servers
+// report it when they become leader and periodically after that. Reports of
+// an earlier epoch come from deposed leaders and are rejected.
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req galaxy.LeaderReport
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	recorded, err := recordLeader(req.ShardID, req.Server, req.Term)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error setting primary: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		http.Error(w, fmt.Sprintf("Epoch %d of shard %s is stale", req.Term, req.ShardID), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// primaryElectHandler no longer elects anyone: the replicas of a shard elect
+// their leader through Raft. It asks the replicas of every given shard which
+// of them leads it and records the leader of the latest term, so that the
+// load balancer does not wait for the leader's next report.
 func primaryElectHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
@@ -189,9 +262,8 @@ func primaryElectHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer rows.Close()
 
-		var primaryServer int
-		maxWalLength := 0
-
+		leader := -1
+		var leaderTerm int64
 		for rows.Next() {
 			var server int
 			err := rows.Scan(&server)
@@ -200,22 +272,23 @@ func primaryElectHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			walLength, err := galaxy.GetServerWalLength(server)
+			status, err := galaxy.GetServerRaftStatus(server, shard)
 			if err != nil {
-				log.Println("Error getting WAL length from Server", server, ":", err)
+				log.Println("Error getting Raft status from Server", server, ":", err)
 				continue
 			}
 
-			if walLength >= maxWalLength {
-				maxWalLength = walLength
-				primaryServer = server
+			if status.Role == galaxy.RAFT_ROLE_LEADER && status.Term > leaderTerm {
+				leader = server
+				leaderTerm = status.Term
 			}
 		}
 
-		log.Println("Setting primary server for", shard, "as Server", primaryServer)
-
-		_, err = db.Exec("UPDATE MapT SET is_primary = TRUE WHERE shard_id = $1 AND server_id = $2;", shard, primaryServer)
-		if err != nil {
+		if leader == -1 {
+			log.Println("No leader for", shard, "yet, waiting for its replicas to elect one")
+			continue
+		}
+		if _, err := recordLeader(shard, leader, leaderTerm); err != nil {
 			http.Error(w, fmt.Sprintf("Error setting primary: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -224,6 +297,105 @@ func primaryElectHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// replicationStatusHandler reports, for every shard or only the one given by
+// shard, the role of each replica and how far each secondary is behind the
+// primary in records and in seconds, as tracked by the primary.
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query("SELECT shard_id, server_id, is_primary, epoch FROM MapT WHERE $1 = '' OR shard_id = $1 ORDER BY shard_id, server_id;", r.URL.Query().Get("shard"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting mapt entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statuses := []*galaxy.ShardReplicationStatus{}
+	servers := make(map[string][]int)
+	for rows.Next() {
+		var shard string
+		var server int
+		var isPrimary bool
+		var epoch int64
+		if err := rows.Scan(&shard, &server, &isPrimary, &epoch); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning rows: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if len(servers[shard]) == 0 {
+			statuses = append(statuses, &galaxy.ShardReplicationStatus{ShardID: shard, Primary: -1})
+		}
+		servers[shard] = append(servers[shard], server)
+		status := statuses[len(statuses)-1]
+		if isPrimary {
+			status.Primary = server
+			status.Epoch = epoch
+		}
+	}
+
+	lags := make(map[int]map[string]map[int]galaxy.ServerReplicaLag)
+	lagErrors := make(map[int]error)
+	for _, status := range statuses {
+		var lagErr error
+		if status.Primary != -1 {
+			raftStatus, err := galaxy.GetServerRaftStatus(status.Primary, status.ShardID)
+			if err != nil {
+				lagErr = err
+			}
+			status.PrimaryLSN = raftStatus.LastLSN
+
+			if _, ok := lags[status.Primary]; !ok && lagErrors[status.Primary] == nil {
+				lags[status.Primary], lagErrors[status.Primary] = galaxy.GetServerReplicationLag(status.Primary)
+			}
+			if lagErr == nil {
+				lagErr = lagErrors[status.Primary]
+			}
+		} else {
+			lagErr = fmt.Errorf("shard %s has no primary", status.ShardID)
+		}
+
+		for _, server := range servers[status.ShardID] {
+			if server == status.Primary {
+				status.Replicas = append(status.Replicas, galaxy.ReplicaStatus{
+					Server:   server,
+					Role:     galaxy.REPLICA_ROLE_PRIMARY,
+					AckedLSN: status.PrimaryLSN,
+				})
+				continue
+			}
+
+			replica := galaxy.ReplicaStatus{
+				Server: server,
+				Role:   galaxy.REPLICA_ROLE_SECONDARY,
+			}
+			lag, ok := lags[status.Primary][status.ShardID][server]
+			switch {
+			case lagErr != nil:
+				replica.Error = lagErr.Error()
+			case !ok:
+				replica.Error = fmt.Sprintf("Server%d is not replicating to Server%d yet", status.Primary, server)
+			default:
+				lastAck := lag.LastAckTime
+				replica.AckedLSN = lag.LastAckedLSN
+				replica.LagRecords = lag.LagRecords
+				replica.LagSeconds = lag.LagSeconds
+				replica.Error = lag.LastError
+				if !lastAck.IsZero() {
+					replica.LastAckTime = &lastAck
+				}
+			}
+			status.Replicas = append(status.Replicas, replica)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
+
 func main() {
 	var err error
 	db, err = sql.Open("postgres", galaxy.DB_CONNECTION_STRING)
@@ -253,6 +425,8 @@ func main() {
 	http.HandleFunc("/check_heartbeat", checkHeartbeatHandler)
 	http.HandleFunc("/shard_servers", shardServersHandler)
 	http.HandleFunc("/primary_elect", primaryElectHandler)
+	http.HandleFunc("/leader", leaderHandler)
+	http.HandleFunc("/replication_status", replicationStatusHandler)
 
 	log.Println("Shard Manager running on port 8000")
 	err = server.ListenAndServe()
@@ -2,7 +2,8 @@ CREATE TABLE IF NOT EXISTS shardt (
     stud_id_low INT PRIMARY KEY,
     shard_id TEXT,
     shard_size INT,
-    valid_idx INT
+    valid_idx INT,
+    replication_mode TEXT NOT NULL DEFAULT 'semi-sync'
 );
 
 
@@ -10,5 +11,31 @@ CREATE TABLE IF NOT EXISTS mapt (
     shard_id TEXT,
     server_id INT,
     is_primary BOOLEAN DEFAULT FALSE,
+    epoch BIGINT NOT NULL DEFAULT 0,
     PRIMARY KEY (shard_id, server_id)
-);
\ No newline at end of file
+);
+
+-- Transactions coordinated by the load balancer with two-phase commit, and
+-- the shards each of them touches.
+CREATE TABLE IF NOT EXISTS txnt (
+    txid TEXT PRIMARY KEY,
+    state TEXT NOT NULL,
+    idempotency_key TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS txn_shardt (
+    txid TEXT REFERENCES txnt (txid) ON DELETE CASCADE,
+    shard_id TEXT,
+    PRIMARY KEY (txid, shard_id)
+);
+
+-- Outcomes of mutations made with an Idempotency-Key header. A key without a
+-- status code is held by a request that is still running.
+CREATE TABLE IF NOT EXISTS idempotencyt (
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status_code INT,
+    response TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -1,5 +1,7 @@
 package galaxydb
 
+import "time"
+
 const (
 	SERVER_DOCKER_IMAGE_NAME = "galaxydb-server"
 	DOCKER_NETWORK_NAME      = "galaxydb-network"
@@ -7,4 +9,115 @@ const (
 	DB_CONNECTION_STRING     = "host=galaxydb-metadata user=postgres password=galaxydb dbname=postgres port=5432 sslmode=disable"
 	LOADBALANCER_URL         = "http://galaxydb-loadbalancer:5000"
 	SHARD_MANAGER_URL        = "http://galaxydb-shard-manager:8000"
+	CATCH_UP_MAX_ROUNDS      = 20
+
+	// Servers archive finished WAL segments into this volume, mounted at
+	// SERVER_WAL_ARCHIVE_PATH, so that they outlive the server containers.
+	// The WAL_ARCHIVE_VOLUME environment variable overrides it with another
+	// volume or a host directory, or disables archiving when empty.
+	WAL_ARCHIVE_VOLUME      = "galaxydb-wal-archive"
+	SERVER_WAL_ARCHIVE_PATH = "/archive"
+
+	CHANGE_FEED_KEEPALIVE      = 15 * time.Second
+	CHANGE_FEED_RETRY_INTERVAL = time.Second
+
+	// A write to a shard whose primary is unknown or has just lost its
+	// leadership is retried for up to PRIMARY_WAIT_TIMEOUT, while the
+	// shard's replicas elect a new leader.
+	PRIMARY_WAIT_TIMEOUT   = 5 * time.Second
+	PRIMARY_RETRY_INTERVAL = 200 * time.Millisecond
+
+	// EPOCH_HEADER carries the epoch of the primary a mutation is sent to.
+	// A server that no longer leads its shard in that epoch rejects it.
+	EPOCH_HEADER = "X-Galaxy-Epoch"
+
+	// RAFT_ROLE_LEADER is the role a server reports for the shards it leads.
+	RAFT_ROLE_LEADER = "leader"
+
+	// Roles of the replicas of a shard in its replication status.
+	REPLICA_ROLE_PRIMARY   = "primary"
+	REPLICA_ROLE_SECONDARY = "secondary"
+)
+
+// Replication modes of a shard. A write to a sync shard waits for every
+// replica, to a semi-sync shard for a quorum of them, and to an async shard
+// only for the primary's WAL.
+const (
+	REPLICATION_MODE_SYNC      = "sync"
+	REPLICATION_MODE_SEMI_SYNC = "semi-sync"
+	REPLICATION_MODE_ASYNC     = "async"
+
+	DEFAULT_REPLICATION_MODE = REPLICATION_MODE_SEMI_SYNC
+)
+
+// Read consistency levels. A primary read is served by the shard's primary,
+// a quorum read by the newest of a majority of its replicas, and an any read
+// by whichever replica the consistent hash map picks.
+const (
+	READ_CONSISTENCY_PRIMARY = "primary"
+	READ_CONSISTENCY_QUORUM  = "quorum"
+	READ_CONSISTENCY_ANY     = "any"
+
+	DEFAULT_READ_CONSISTENCY = READ_CONSISTENCY_ANY
 )
+
+// Operations of a transaction.
+const (
+	TXN_OP_WRITE  = "write"
+	TXN_OP_UPDATE = "update"
+	TXN_OP_DELETE = "delete"
+)
+
+// States of a transaction in txnt. A transaction is committed once it
+// reaches TXN_STATE_COMMITTING, and aborted once it reaches
+// TXN_STATE_ABORTING, whether or not every shard has been told yet.
+const (
+	TXN_STATE_PREPARING  = "preparing"
+	TXN_STATE_COMMITTING = "committing"
+	TXN_STATE_ABORTING   = "aborting"
+	TXN_STATE_COMMITTED  = "committed"
+	TXN_STATE_ABORTED    = "aborted"
+
+	// Every TXN_RESOLVE_INTERVAL, transactions whose shards have not all
+	// been told the outcome are told again, and transactions still being
+	// prepared after TXN_PREPARE_TIMEOUT are presumed abandoned by their
+	// coordinator and aborted. Finished transactions are forgotten after
+	// TXN_RETENTION.
+	TXN_RESOLVE_INTERVAL = 10 * time.Second
+	TXN_PREPARE_TIMEOUT  = 30 * time.Second
+	TXN_RETENTION        = 24 * time.Hour
+)
+
+// Mutations carrying an IDEMPOTENCY_KEY_HEADER of up to
+// MAX_IDEMPOTENCY_KEY_LENGTH bytes are made once per key. Their outcome is
+// kept for IDEMPOTENCY_WINDOW, overridable through the environment variable
+// of the same name, and returned to retries with the
+// IDEMPOTENT_REPLAYED_HEADER set. A key whose request has not finished after
+// IDEMPOTENCY_PENDING_TIMEOUT is presumed abandoned, and may be retried.
+const (
+	IDEMPOTENCY_KEY_HEADER      = "Idempotency-Key"
+	MAX_IDEMPOTENCY_KEY_LENGTH  = 255
+	IDEMPOTENT_REPLAYED_HEADER  = "Idempotent-Replayed"
+	IDEMPOTENCY_WINDOW          = 24 * time.Hour
+	IDEMPOTENCY_PENDING_TIMEOUT = time.Minute
+	IDEMPOTENCY_EXPIRE_INTERVAL = time.Hour
+)
+
+// SERVER_ENV_PASSTHROUGH lists the environment variables that are copied from
+// the load balancer to every server it spawns.
+var SERVER_ENV_PASSTHROUGH = []string{
+	"WAL_GROUP_COMMIT_WINDOW",
+	"WAL_GROUP_COMMIT_MAX_BATCH",
+	"SNAPSHOT_RETENTION",
+	"WAL_ARCHIVE_URL",
+	"REPLICATION_QUORUM",
+	"REPLICATION_TIMEOUT",
+	"RAFT_HEARTBEAT_INTERVAL",
+	"RAFT_ELECTION_TIMEOUT",
+	"RAFT_RPC_TIMEOUT",
+	"RAFT_MAX_ENTRIES",
+	"RAFT_MEMBERSHIP_REFRESH_INTERVAL",
+	"RAFT_LEADER_REPORT_INTERVAL",
+	"READ_WAIT_TIMEOUT",
+	"IDEMPOTENCY_WINDOW",
+}
@@ -1,7 +1,9 @@
 package galaxydb
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/yatharthsameer/galaxydb/loadbalancer/internal/consistenthashmap"
 )
@@ -12,9 +14,10 @@ type ShardTConfig struct {
 }
 
 type Shard struct {
-	StudIDLow int    `json:"Stud_id_low"`
-	ShardID   string `json:"Shard_id"`
-	ShardSize int    `json:"Shard_size"`
+	StudIDLow       int    `json:"Stud_id_low"`
+	ShardID         string `json:"Shard_id"`
+	ShardSize       int    `json:"Shard_size"`
+	ReplicationMode string `json:"Replication_mode,omitempty"`
 }
 
 type SchemaConfig struct {
@@ -61,9 +64,12 @@ type RemoveResponseFailed struct {
 	Status  string `json:"status"`
 }
 
+// Standalone shards are configured outside of their replica sets, and never
+// join their Raft groups.
 type ServerConfigPayload struct {
-	Schema SchemaConfig `json:"schema"`
-	Shards []string     `json:"shards"`
+	Schema     SchemaConfig `json:"schema"`
+	Shards     []string     `json:"shards"`
+	Standalone bool         `json:"standalone,omitempty"`
 }
 
 type StudT struct {
@@ -77,6 +83,8 @@ type ReadRequest struct {
 		Low  int `json:"low"`
 		High int `json:"high"`
 	} `json:"Stud_id"`
+	Consistency string `json:"consistency,omitempty"`
+	Token       string `json:"token,omitempty"`
 }
 
 type ReadResponse struct {
@@ -91,19 +99,30 @@ type ServerReadPayload struct {
 		Low  int `json:"low"`
 		High int `json:"high"`
 	} `json:"Stud_id"`
+	MinLSN int64 `json:"min_lsn,omitempty"`
 }
 
+// ServerReadResponse carries the LSN of the last record the server had
+// applied to the shard when it read the rows.
 type ServerReadResponse struct {
 	Status string  `json:"status"`
 	Data   []StudT `json:"data"`
+	LSN    int64   `json:"lsn"`
 }
 
+// Mutations may carry the session token of earlier ones, and answer with a
+// token that also covers their own, for later reads to pass along.
+// An atomic write is made as one transaction across every shard it touches.
 type WriteRequest struct {
-	Data []StudT `json:"data"`
+	Data   []StudT `json:"data"`
+	Atomic bool    `json:"atomic,omitempty"`
+	Token  string  `json:"token,omitempty"`
 }
 
 type WriteResponse struct {
 	Message string `json:"message"`
+	TxID    string `json:"txid,omitempty"`
+	Token   string `json:"token"`
 	Status  string `json:"status"`
 }
 
@@ -112,18 +131,23 @@ type ServerWritePayload struct {
 	Data  []StudT `json:"data"`
 }
 
+// ServerWriteResponse is how a server answers a write, update or delete,
+// with the LSN of the WAL record it logged it as.
 type ServerWriteResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	LSN     int64  `json:"lsn"`
 }
 
 type UpdateRequest struct {
-	StudID int   `json:"Stud_id"`
-	Data   StudT `json:"data"`
+	StudID int    `json:"Stud_id"`
+	Data   StudT  `json:"data"`
+	Token  string `json:"token,omitempty"`
 }
 
 type UpdateResponse struct {
 	Message string `json:"message"`
+	Token   string `json:"token"`
 	Status  string `json:"status"`
 }
 
@@ -134,11 +158,13 @@ type ServerUpdatePayload struct {
 }
 
 type DeleteRequest struct {
-	StudID int `json:"Stud_id"`
+	StudID int    `json:"Stud_id"`
+	Token  string `json:"token,omitempty"`
 }
 
 type DeleteResponse struct {
 	Message string `json:"message"`
+	Token   string `json:"token"`
 	Status  string `json:"status"`
 }
 
@@ -147,12 +173,121 @@ type ServerDeletePayload struct {
 	StudID int    `json:"Stud_id"`
 }
 
+// TransactionOp is one operation of a transaction: a write of the rows of
+// Data, an update of Stud_id to the only row of Data, or a delete of Stud_id.
+type TransactionOp struct {
+	Op     string  `json:"op"`
+	StudID int     `json:"Stud_id,omitempty"`
+	Data   []StudT `json:"data,omitempty"`
+}
+
+type TransactionRequest struct {
+	Ops   []TransactionOp `json:"ops"`
+	Token string          `json:"token,omitempty"`
+}
+
+type TransactionResponse struct {
+	Message string `json:"message"`
+	TxID    string `json:"txid"`
+	Token   string `json:"token"`
+	Status  string `json:"status"`
+}
+
+// IdempotentOutcome is what a mutation made with an idempotency key answered,
+// or a StatusCode of 0 while it is still running.
+type IdempotentOutcome struct {
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+}
+
+// ServerTxnOp is a TransactionOp on the shard it is sent to.
+type ServerTxnOp struct {
+	Op     string  `json:"op"`
+	StudID int     `json:"Stud_id,omitempty"`
+	Data   []StudT `json:"data,omitempty"`
+}
+
+type ServerPreparePayload struct {
+	Shard string        `json:"shard"`
+	TxID  string        `json:"txid"`
+	Ops   []ServerTxnOp `json:"ops"`
+}
+
+// ServerTxnPayload commits or aborts a transaction prepared on a shard.
+type ServerTxnPayload struct {
+	Shard string `json:"shard"`
+	TxID  string `json:"txid"`
+}
+
 type ServerCopyPayload struct {
 	Shards []string `json:"shards"`
 }
 
 type ServerCopyResponse map[string][]StudT
 
+// Prepared holds the transactions prepared on the shard, passed through as
+// the server encoded them.
+type ServerSnapshot struct {
+	Shard    string          `json:"shard"`
+	LSN      int64           `json:"lsn"`
+	Term     int64           `json:"term"`
+	Data     []StudT         `json:"data"`
+	Prepared json.RawMessage `json:"prepared,omitempty"`
+}
+
+type ServerCatchUpPayload struct {
+	Shard  string `json:"shard"`
+	Source int    `json:"source"`
+}
+
+type ServerCatchUpResponse struct {
+	Shard   string `json:"shard"`
+	LSN     int64  `json:"lsn"`
+	Records int    `json:"records"`
+	Status  string `json:"status"`
+}
+
+type RestoreRequest struct {
+	Shard     string `json:"shard"`
+	LSN       int64  `json:"lsn"`
+	Timestamp string `json:"timestamp"`
+	NewShard  string `json:"new_shard"`
+	Server    string `json:"server"`
+}
+
+type RestoreResponse struct {
+	Message string `json:"message"`
+	Server  string `json:"server"`
+	Shard   string `json:"shard"`
+	LSN     int64  `json:"lsn"`
+	Status  string `json:"status"`
+}
+
+type ServerRestorePayload struct {
+	Shard       string `json:"shard"`
+	TargetShard string `json:"target_shard"`
+	LSN         int64  `json:"lsn,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+}
+
+type ServerRestoreResponse struct {
+	Message string `json:"message"`
+	Shard   string `json:"shard"`
+	LSN     int64  `json:"lsn"`
+	Rows    int    `json:"rows"`
+	Status  string `json:"status"`
+}
+
+// ShardChangeEvent is one Server-Sent Event relayed from a shard's change
+// feed. Data is passed through as the server encoded it.
+type ShardChangeEvent struct {
+	Shard    string
+	Position int64
+	Event    string
+	Data     string
+}
+
 type ReplaceServerRequest struct {
 	DownServerID int `json:"down_server_id"`
 	NewServerID  int `json:"new_server_id"`
@@ -163,10 +298,59 @@ type ShardServersRequest struct {
 }
 
 type ShardServersResponse struct {
-	ServerIDs []int `json:"servers"`
-	Primary   int   `json:"primary"`
+	ServerIDs       []int  `json:"servers"`
+	Primary         int    `json:"primary"`
+	ReplicationMode string `json:"replication_mode"`
 }
 
 type PrimaryElectRequest struct {
 	ShardIDs []string `json:"shard_ids"`
 }
+
+// LeaderReport is sent by a server when it becomes the leader of a shard's
+// Raft group.
+type LeaderReport struct {
+	ShardID string `json:"shard_id"`
+	Server  int    `json:"server"`
+	Term    int64  `json:"term"`
+}
+
+// ServerRaftStatus is a server's view of a shard's Raft group.
+type ServerRaftStatus struct {
+	Shard      string `json:"shard"`
+	Role       string `json:"role"`
+	Term       int64  `json:"term"`
+	Leader     int    `json:"leader"`
+	LastLSN    int64  `json:"last_lsn"`
+	CommitLSN  int64  `json:"commit_lsn"`
+	AppliedLSN int64  `json:"applied_lsn"`
+}
+
+// ServerReplicaLag is what a primary reports about one of its secondaries.
+type ServerReplicaLag struct {
+	LastAckedLSN int64     `json:"last_acked_lsn"`
+	LastAckTime  time.Time `json:"last_ack_time"`
+	LastError    string    `json:"last_error,omitempty"`
+	LagRecords   int64     `json:"lag_records"`
+	LagSeconds   float64   `json:"lag_seconds"`
+}
+
+// ReplicaStatus is one replica of a shard in the shard manager's
+// replication status.
+type ReplicaStatus struct {
+	Server      int        `json:"server"`
+	Role        string     `json:"role"`
+	AckedLSN    int64      `json:"acked_lsn"`
+	LastAckTime *time.Time `json:"last_ack_time,omitempty"`
+	LagRecords  int64      `json:"lag_records"`
+	LagSeconds  float64    `json:"lag_seconds"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type ShardReplicationStatus struct {
+	ShardID    string          `json:"shard_id"`
+	Primary    int             `json:"primary"`
+	Epoch      int64           `json:"epoch"`
+	PrimaryLSN int64           `json:"primary_lsn"`
+	Replicas   []ReplicaStatus `json:"replicas"`
+}
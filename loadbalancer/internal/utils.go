@@ -1,18 +1,26 @@
 package galaxydb
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	crand "crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func GetSchemaConfig() SchemaConfig {
@@ -56,7 +64,21 @@ func BuildServerInstance() error {
 }
 
 func SpawnNewServerInstance(hostname string, id int) error {
-	cmd := exec.Command("sudo", "docker", "run", "--rm", "-d", "--name", hostname, "--network", DOCKER_NETWORK_NAME, "-e", fmt.Sprintf("id=%d", id), fmt.Sprintf("%s:latest", SERVER_DOCKER_IMAGE_NAME))
+	args := []string{"docker", "run", "--rm", "-d", "--name", hostname, "--network", DOCKER_NETWORK_NAME, "-e", fmt.Sprintf("id=%d", id)}
+	archiveVolume, ok := os.LookupEnv("WAL_ARCHIVE_VOLUME")
+	if !ok {
+		archiveVolume = WAL_ARCHIVE_VOLUME
+	}
+	if archiveVolume != "" {
+		args = append(args, "-v", fmt.Sprintf("%s:%s", archiveVolume, SERVER_WAL_ARCHIVE_PATH), "-e", fmt.Sprintf("WAL_ARCHIVE_DIR=%s", SERVER_WAL_ARCHIVE_PATH))
+	}
+	for _, key := range SERVER_ENV_PASSTHROUGH {
+		if value, ok := os.LookupEnv(key); ok {
+			args = append(args, "-e", fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	args = append(args, fmt.Sprintf("%s:latest", SERVER_DOCKER_IMAGE_NAME))
+	cmd := exec.Command("sudo", args...)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -79,10 +101,23 @@ func GetServerIP(hostname string) string {
 }
 
 func ConfigNewServerInstance(serverID int, shards []string) error {
-	payload := ServerConfigPayload{
+	return configServerInstance(serverID, ServerConfigPayload{
 		Schema: GetSchemaConfig(),
 		Shards: shards,
-	}
+	})
+}
+
+// ConfigStandaloneServerInstance configures copies of shards on a server that
+// is not one of their replicas.
+func ConfigStandaloneServerInstance(serverID int, shards []string) error {
+	return configServerInstance(serverID, ServerConfigPayload{
+		Schema:     GetSchemaConfig(),
+		Shards:     shards,
+		Standalone: true,
+	})
+}
+
+func configServerInstance(serverID int, payload ServerConfigPayload) error {
 	payloadData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("error marshaling JSON: %v", err)
@@ -175,6 +210,21 @@ func GetValidIDx(db *sql.DB, shardID string) (int, error) {
 	return validIDx, nil
 }
 
+// ValidateReplicationModes fills in the default replication mode of shards
+// that do not set one and rejects unknown modes.
+func ValidateReplicationModes(shards []Shard) error {
+	for i, shard := range shards {
+		switch shard.ReplicationMode {
+		case "":
+			shards[i].ReplicationMode = DEFAULT_REPLICATION_MODE
+		case REPLICATION_MODE_SYNC, REPLICATION_MODE_SEMI_SYNC, REPLICATION_MODE_ASYNC:
+		default:
+			return fmt.Errorf("unknown replication mode %q for shard %s", shard.ReplicationMode, shard.ShardID)
+		}
+	}
+	return nil
+}
+
 func GetServerIDsForShard(db *sql.DB, shardID string) ([]int, error) {
 	row, err := db.Query("SELECT server_id FROM mapt WHERE shard_id=$1", shardID)
 	if err != nil {
@@ -225,114 +275,933 @@ func ReplaceServerInstance(db *sql.DB, downServerID int, newServerID int, server
 	primaryShardList := []string{}
 
 	for _, shardID := range shardIDs {
-		shardTConfigs[shardID].Mutex.Lock()
-		shardTConfigs[shardID].CHM.RemoveServer(downServerID)
+		isPrimary, err := ReplaceShardReplica(db, shardID, downServerID, newServerID, shardTConfigs[shardID])
+		if err != nil {
+			return nil, err
+		}
+		if isPrimary {
+			primaryShardList = append(primaryShardList, shardID)
+		}
+	}
 
-		payload := ServerCopyPayload{
-			Shards: []string{shardID},
+	if len(primaryShardList) != 0 {
+		payload := PrimaryElectRequest{
+			ShardIDs: primaryShardList,
 		}
+
 		payloadData, err := json.Marshal(payload)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling JSON: %v", err)
 		}
 
-		existingServerID := shardTConfigs[shardID].CHM.GetServerForRequest(GetRandomID())
-
-		req, err := http.NewRequest("GET", "http://"+GetServerIP(fmt.Sprintf("Server%d", existingServerID))+":"+fmt.Sprint(SERVER_PORT)+"/copy", bytes.NewBuffer(payloadData))
+		_, err = http.Post(SHARD_MANAGER_URL+"/primary_elect", "application/json", bytes.NewBuffer(payloadData))
 		if err != nil {
-			return nil, fmt.Errorf("error creating request: %v", err)
+			return nil, fmt.Errorf("error electing primary: %v", err)
 		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error copying from server: %v", err)
+	}
+
+	newServerIDs := []int{}
+	for _, serverID := range serverIDs {
+		if serverID != downServerID {
+			newServerIDs = append(newServerIDs, serverID)
+		}
+	}
+	newServerIDs = append(newServerIDs, newServerID)
+
+	return newServerIDs, nil
+}
+
+// GetPrimaryServerIDForShard returns the primary of shardID, or -1 if the
+// shard has none.
+func GetPrimaryServerIDForShard(db *sql.DB, shardID string) (int, error) {
+	serverID, _, err := GetPrimaryWithEpochForShard(db, shardID)
+	return serverID, err
+}
+
+// GetPrimaryWithEpochForShard returns the primary of shardID and the epoch
+// it was elected in, or -1 if the shard has none. The epoch is the Raft term
+// of the primary's leadership and only ever grows.
+func GetPrimaryWithEpochForShard(db *sql.DB, shardID string) (int, int64, error) {
+	serverID := -1
+	var epoch int64
+	row := db.QueryRow("SELECT server_id, epoch FROM mapt WHERE shard_id=$1 AND is_primary=TRUE", shardID)
+	err := row.Scan(&serverID, &epoch)
+	if err == sql.ErrNoRows {
+		return -1, 0, nil
+	}
+	if err != nil {
+		return -1, 0, fmt.Errorf("error scanning row: %v", err)
+	}
+	return serverID, epoch, nil
+}
+
+// errNoPrimary is returned by sendToPrimaryOnce when the write may succeed
+// once the shard's replicas have elected a leader.
+var errNoPrimary = errors.New("no primary")
+
+// SendToPrimary sends a mutation of shardID to the shard's primary, the
+// leader of its Raft group, which logs it and replicates it to the other
+// replicas. Other replicas reject mutations, so there is no other way in. The
+// primary's epoch goes along as a fencing token, so that a deposed primary
+// that has not noticed yet refuses the mutation instead of accepting it.
+// While the shard has no known leader, or the recorded one has lost its
+// leadership, the mutation is retried until PRIMARY_WAIT_TIMEOUT. It returns
+// the LSN of the WAL record the mutation was logged as. The mutation carries
+// the client's idempotency key, if any, so that the shard applies it once.
+func SendToPrimary(db *sql.DB, shardID string, method string, route string, payload interface{}, key string) (int64, error) {
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	deadline := time.Now().Add(PRIMARY_WAIT_TIMEOUT)
+	for {
+		lsn, err := sendToPrimaryOnce(db, shardID, method, route, payloadData, key)
+		if !errors.Is(err, errNoPrimary) || time.Now().After(deadline) {
+			return lsn, err
 		}
+		time.Sleep(PRIMARY_RETRY_INTERVAL)
+	}
+}
+
+func sendToPrimaryOnce(db *sql.DB, shardID string, method string, route string, payloadData []byte, key string) (int64, error) {
+	primary, epoch, err := GetPrimaryWithEpochForShard(db, shardID)
+	if err != nil {
+		return 0, err
+	}
+	if primary == -1 {
+		return 0, fmt.Errorf("%w: shard %s has no primary", errNoPrimary, shardID)
+	}
+
+	req, err := http.NewRequest(method, "http://"+GetServerIP(fmt.Sprintf("Server%d", primary))+":"+fmt.Sprint(SERVER_PORT)+route, bytes.NewBuffer(payloadData))
+	if err != nil {
+		return 0, fmt.Errorf("error creating server request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if epoch > 0 {
+		req.Header.Set(EPOCH_HEADER, strconv.FormatInt(epoch, 10))
+	}
+	if key != "" {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending %s to Server%d: %v", route, primary, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("%w: Server%d is not the leader of shard %s: %s", errNoPrimary, primary, shardID, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("error from primary Server%d: %s", primary, strings.TrimSpace(string(body)))
+	}
+
+	var respData ServerWriteResponse
+	err = json.NewDecoder(resp.Body).Decode(&respData)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding response from primary Server%d: %v", primary, err)
+	}
+	return respData.LSN, nil
+}
+
+// ReadFromServer reads the rows of a shard from serverID.
+func ReadFromServer(serverID int, payload ServerReadPayload) (ServerReadResponse, error) {
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return ServerReadResponse{}, fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	resp, err := http.Post("http://"+GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(SERVER_PORT)+"/read", "application/json", bytes.NewBuffer(payloadData))
+	if err != nil {
+		return ServerReadResponse{}, fmt.Errorf("error reading from Server%d: %v", serverID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerReadResponse{}, fmt.Errorf("error reading from Server%d: %s", serverID, strings.TrimSpace(string(body)))
+	}
+
+	var respData ServerReadResponse
+	err = json.NewDecoder(resp.Body).Decode(&respData)
+	if err != nil {
+		return ServerReadResponse{}, fmt.Errorf("error decoding read response: %v", err)
+	}
+	return respData, nil
+}
+
+// ReadAtLeast reads the rows of a shard from serverID, or from its primary if
+// serverID has not applied the WAL up to minLSN within the time the server
+// waits for it, so that a session reads its own writes.
+func ReadAtLeast(db *sql.DB, serverID int, payload ServerReadPayload) (ServerReadResponse, error) {
+	respData, err := ReadFromServer(serverID, payload)
+	if err != nil || respData.LSN >= payload.MinLSN {
+		return respData, err
+	}
+	log.Printf("Server%d has applied shard %s up to %d of %d, reading from its primary\n", serverID, payload.Shard, respData.LSN, payload.MinLSN)
+	return ReadFromPrimary(db, payload)
+}
 
-		body, err := io.ReadAll(resp.Body)
+// ReadFromPrimary reads the rows of a shard from its primary. While the shard
+// has no known leader, the read is retried until PRIMARY_WAIT_TIMEOUT.
+func ReadFromPrimary(db *sql.DB, payload ServerReadPayload) (ServerReadResponse, error) {
+	deadline := time.Now().Add(PRIMARY_WAIT_TIMEOUT)
+	for {
+		primary, err := GetPrimaryServerIDForShard(db, payload.Shard)
 		if err != nil {
-			return nil, fmt.Errorf("error reading response body: %v", err)
+			return ServerReadResponse{}, err
+		}
+		if primary != -1 {
+			respData, err := ReadFromServer(primary, payload)
+			if err == nil && respData.LSN < payload.MinLSN {
+				return ServerReadResponse{}, fmt.Errorf("primary Server%d has applied shard %s up to %d, not %d", primary, payload.Shard, respData.LSN, payload.MinLSN)
+			}
+			return respData, err
+		}
+		if time.Now().After(deadline) {
+			return ServerReadResponse{}, fmt.Errorf("shard %s has no primary", payload.Shard)
 		}
+		time.Sleep(PRIMARY_RETRY_INTERVAL)
+	}
+}
+
+// ReadFromQuorum reads the rows of a shard from every replica at once, and
+// returns those of the replica that had applied the most records once a
+// majority of them have answered. Every committed write has reached a
+// majority, so at least one of them has applied it, provided it has caught up
+// with its commit index.
+func ReadFromQuorum(db *sql.DB, payload ServerReadPayload) (ServerReadResponse, error) {
+	serverIDs, err := GetServerIDsForShard(db, payload.Shard)
+	if err != nil {
+		return ServerReadResponse{}, err
+	}
+	quorum := len(serverIDs)/2 + 1
+
+	type result struct {
+		response ServerReadResponse
+		err      error
+	}
+	results := make(chan result, len(serverIDs))
+	for _, serverID := range serverIDs {
+		go func(serverID int) {
+			response, err := ReadFromServer(serverID, payload)
+			results <- result{response: response, err: err}
+		}(serverID)
+	}
+
+	var newest ServerReadResponse
+	answered := 0
+	errs := []string{}
+	for range serverIDs {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, result.err.Error())
+			continue
+		}
+		if answered == 0 || result.response.LSN > newest.LSN {
+			newest = result.response
+		}
+		answered++
+		if answered >= quorum {
+			if newest.LSN < payload.MinLSN {
+				return ReadFromPrimary(db, payload)
+			}
+			return newest, nil
+		}
+	}
+	return ServerReadResponse{}, fmt.Errorf("only %d of %d replicas of shard %s answered, %d needed: %s", answered, len(serverIDs), payload.Shard, quorum, strings.Join(errs, "; "))
+}
+
+func NewTransactionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return "", fmt.Errorf("error generating transaction ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
 
-		var respData ServerCopyResponse
-		json.Unmarshal(body, &respData)
-		resp.Body.Close()
+// RunTransaction makes the operations of shardOps, by shard, as one
+// transaction with two-phase commit over the shards' primaries. The
+// transaction is recorded in txnt before any shard prepares it, and is
+// committed by moving it to TXN_STATE_COMMITTING once every shard has, so
+// that ResolveTransactions can finish it if the load balancer stops midway.
+// It returns the transaction's ID and the LSN of the commit in each shard
+// that has been told yet. Shards that have committed a transaction with the
+// same idempotency key before neither prepare nor commit this one.
+func RunTransaction(db *sql.DB, shardOps map[string][]ServerTxnOp, key string) (string, map[string]int64, error) {
+	txID, err := NewTransactionID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	shardIDs := make([]string, 0, len(shardOps))
+	for shardID := range shardOps {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
 
-		shardData := respData[shardID]
+	if err := beginTransaction(db, txID, shardIDs, key); err != nil {
+		return "", nil, err
+	}
 
-		payloadWrite := ServerWritePayload{
+	for _, shardID := range shardIDs {
+		payload := ServerPreparePayload{
 			Shard: shardID,
-			Data:  shardData,
+			TxID:  txID,
+			Ops:   shardOps[shardID],
 		}
-		payloadData, err = json.Marshal(payloadWrite)
+		_, err := SendToPrimary(db, shardID, "POST", "/prepare", payload, key)
 		if err != nil {
-			return nil, fmt.Errorf("error marshaling JSON: %v", err)
+			abortTransaction(db, txID)
+			return txID, nil, fmt.Errorf("error preparing transaction %s in shard %s: %v", txID, shardID, err)
 		}
+	}
+
+	committed, err := setTransactionState(db, txID, TXN_STATE_PREPARING, TXN_STATE_COMMITTING)
+	if err != nil {
+		return txID, nil, fmt.Errorf("error committing transaction %s, which will be aborted: %v", txID, err)
+	}
+	if !committed {
+		// ResolveTransactions gave up on the transaction while it was
+		// being prepared, perhaps before some shard had prepared it.
+		abortTransaction(db, txID)
+		return txID, nil, fmt.Errorf("transaction %s was aborted while it was being prepared", txID)
+	}
+
+	positions, err := finishTransaction(db, txID, TXN_STATE_COMMITTING)
+	if err != nil {
+		log.Printf("Transaction %s is committed, but not yet in every shard: %v\n", txID, err)
+	}
+	return txID, positions, nil
+}
+
+// abortTransaction aborts a transaction that is still being prepared, or
+// has already been given up on, in every shard it touches.
+func abortTransaction(db *sql.DB, txID string) {
+	if _, err := setTransactionState(db, txID, TXN_STATE_PREPARING, TXN_STATE_ABORTING); err != nil {
+		log.Printf("Error aborting transaction %s: %v\n", txID, err)
+		return
+	}
+	if _, err := finishTransaction(db, txID, TXN_STATE_ABORTING); err != nil {
+		log.Printf("Transaction %s is aborted, but not yet in every shard: %v\n", txID, err)
+	}
+}
+
+func beginTransaction(db *sql.DB, txID string, shardIDs []string, key string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
 
-		_, err = http.Post("http://"+GetServerIP(fmt.Sprintf("Server%d", newServerID))+":"+fmt.Sprint(SERVER_PORT)+"/write", "application/json", bytes.NewBuffer(payloadData))
+	_, err = tx.Exec("INSERT INTO txnt (txid, state, idempotency_key) VALUES ($1, $2, NULLIF($3, ''))", txID, TXN_STATE_PREPARING, key)
+	if err != nil {
+		return fmt.Errorf("error inserting into txnt: %v", err)
+	}
+	for _, shardID := range shardIDs {
+		_, err = tx.Exec("INSERT INTO txn_shardt (txid, shard_id) VALUES ($1, $2)", txID, shardID)
 		if err != nil {
-			return nil, fmt.Errorf("error writing to new server: %v", err)
+			return fmt.Errorf("error inserting into txn_shardt: %v", err)
 		}
+	}
 
-		shardTConfigs[shardID].CHM.AddServer(newServerID)
-		shardTConfigs[shardID].Mutex.Unlock()
+	return tx.Commit()
+}
 
-		row := db.QueryRow("SELECT is_primary FROM mapt WHERE shard_id=$1 AND server_id=$2", shardID, downServerID)
-		isPrimary := false
-		err = row.Scan(&isPrimary)
-		if err != nil {
+// setTransactionState moves a transaction from one state to another, and
+// reports whether it was still in the first.
+func setTransactionState(db *sql.DB, txID string, from string, to string) (bool, error) {
+	result, err := db.Exec("UPDATE txnt SET state=$3, updated_at=NOW() WHERE txid=$1 AND state=$2", txID, from, to)
+	if err != nil {
+		return false, fmt.Errorf("error updating txnt: %v", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error updating txnt: %v", err)
+	}
+	return updated > 0, nil
+}
+
+// finishTransaction tells every shard of a transaction in
+// TXN_STATE_COMMITTING or TXN_STATE_ABORTING its outcome, and records it as
+// finished once they all know. It returns the LSN each shard logged the
+// outcome at.
+func finishTransaction(db *sql.DB, txID string, state string) (map[string]int64, error) {
+	route, finished := "/commit", TXN_STATE_COMMITTED
+	if state == TXN_STATE_ABORTING {
+		route, finished = "/abort", TXN_STATE_ABORTED
+	}
+
+	var key string
+	err := db.QueryRow("SELECT COALESCE(idempotency_key, '') FROM txnt WHERE txid=$1", txID).Scan(&key)
+	if err != nil {
+		return nil, fmt.Errorf("error querying txnt: %v", err)
+	}
+
+	rows, err := db.Query("SELECT shard_id FROM txn_shardt WHERE txid=$1 ORDER BY shard_id", txID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying txn_shardt: %v", err)
+	}
+	shardIDs := []string{}
+	for rows.Next() {
+		var shardID string
+		if err := rows.Scan(&shardID); err != nil {
+			rows.Close()
 			return nil, fmt.Errorf("error scanning row: %v", err)
 		}
-		if isPrimary {
-			primaryShardList = append(primaryShardList, shardID)
+		shardIDs = append(shardIDs, shardID)
+	}
+	rows.Close()
+
+	positions := make(map[string]int64)
+	errs := []string{}
+	for _, shardID := range shardIDs {
+		lsn, err := SendToPrimary(db, shardID, "POST", route, ServerTxnPayload{Shard: shardID, TxID: txID}, key)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("shard %s: %v", shardID, err))
+			continue
 		}
+		if lsn > 0 {
+			positions[shardID] = lsn
+		}
+	}
+	if len(errs) > 0 {
+		return positions, errors.New(strings.Join(errs, "; "))
 	}
 
-	_, err = db.Exec("UPDATE mapt SET server_id=$1, is_primary=FALSE WHERE server_id=$2", newServerID, downServerID)
+	_, err = setTransactionState(db, txID, state, finished)
+	return positions, err
+}
+
+// ResolveTransactions finishes the transactions whose shards have not all
+// been told the outcome, and aborts those that have been preparing for
+// longer than preparingFor.
+func ResolveTransactions(db *sql.DB, preparingFor time.Duration) error {
+	rows, err := db.Query("SELECT txid, state FROM txnt WHERE state IN ($1, $2) OR (state=$3 AND updated_at < NOW() - make_interval(secs => $4))",
+		TXN_STATE_COMMITTING, TXN_STATE_ABORTING, TXN_STATE_PREPARING, preparingFor.Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("error updating mapt: %v", err)
+		return fmt.Errorf("error querying txnt: %v", err)
+	}
+	states := make(map[string]string)
+	for rows.Next() {
+		var txID, state string
+		if err := rows.Scan(&txID, &state); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning row: %v", err)
+		}
+		states[txID] = state
 	}
+	rows.Close()
 
-	if len(primaryShardList) != 0 {
-		payload := PrimaryElectRequest{
-			ShardIDs: primaryShardList,
+	for txID, state := range states {
+		if state == TXN_STATE_PREPARING {
+			aborted, err := setTransactionState(db, txID, TXN_STATE_PREPARING, TXN_STATE_ABORTING)
+			if err != nil {
+				log.Printf("Error aborting transaction %s: %v\n", txID, err)
+				continue
+			}
+			if !aborted {
+				continue
+			}
+			state = TXN_STATE_ABORTING
 		}
 
-		payloadData, err := json.Marshal(payload)
+		if _, err := finishTransaction(db, txID, state); err != nil {
+			log.Printf("Error resolving transaction %s: %v\n", txID, err)
+			continue
+		}
+		log.Printf("Resolved in-doubt transaction %s: %s\n", txID, state)
+	}
+
+	_, err = db.Exec("DELETE FROM txnt WHERE state IN ($1, $2) AND updated_at < NOW() - make_interval(secs => $3)",
+		TXN_STATE_COMMITTED, TXN_STATE_ABORTED, TXN_RETENTION.Seconds())
+	if err != nil {
+		return fmt.Errorf("error deleting from txnt: %v", err)
+	}
+	return nil
+}
+
+// ResolveTransactionsPeriodically resolves in-doubt transactions every
+// TXN_RESOLVE_INTERVAL. It starts by aborting every transaction still being
+// prepared, since their coordinator was a load balancer that has stopped.
+func ResolveTransactionsPeriodically(db *sql.DB) {
+	preparingFor := time.Duration(0)
+	for {
+		if err := ResolveTransactions(db, preparingFor); err != nil {
+			log.Printf("Error resolving transactions: %v\n", err)
+		}
+		preparingFor = TXN_PREPARE_TIMEOUT
+		time.Sleep(TXN_RESOLVE_INTERVAL)
+	}
+}
+
+// ReserveIdempotencyKey claims key for a request with requestHash, unless
+// another request holds it. It returns false with the outcome of that
+// request otherwise. Keys past IDEMPOTENCY_WINDOW, and keys of requests that
+// have been running for longer than IDEMPOTENCY_PENDING_TIMEOUT, are claimed
+// anew.
+func ReserveIdempotencyKey(db *sql.DB, key string, requestHash string) (IdempotentOutcome, bool, error) {
+	result, err := db.Exec(`INSERT INTO idempotencyt (key, request_hash) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET request_hash=EXCLUDED.request_hash, status_code=NULL, response=NULL, created_at=NOW()
+		WHERE idempotencyt.created_at < NOW() - make_interval(secs => $3)
+			OR (idempotencyt.status_code IS NULL AND idempotencyt.created_at < NOW() - make_interval(secs => $4))`,
+		key, requestHash, GetEnvDuration("IDEMPOTENCY_WINDOW", IDEMPOTENCY_WINDOW).Seconds(), IDEMPOTENCY_PENDING_TIMEOUT.Seconds())
+	if err != nil {
+		return IdempotentOutcome{}, false, fmt.Errorf("error inserting into idempotencyt: %v", err)
+	}
+	if reserved, err := result.RowsAffected(); err != nil || reserved > 0 {
+		return IdempotentOutcome{}, reserved > 0, err
+	}
+
+	var outcome IdempotentOutcome
+	var statusCode sql.NullInt64
+	var response sql.NullString
+	err = db.QueryRow("SELECT request_hash, status_code, response FROM idempotencyt WHERE key=$1", key).Scan(&outcome.RequestHash, &statusCode, &response)
+	if err != nil {
+		return IdempotentOutcome{}, false, fmt.Errorf("error querying idempotencyt: %v", err)
+	}
+	outcome.StatusCode = int(statusCode.Int64)
+	outcome.Response = []byte(response.String)
+	return outcome, false, nil
+}
+
+// StoreIdempotentOutcome records what the request holding key answered.
+func StoreIdempotentOutcome(db *sql.DB, key string, statusCode int, response []byte) error {
+	_, err := db.Exec("UPDATE idempotencyt SET status_code=$2, response=$3 WHERE key=$1", key, statusCode, string(response))
+	if err != nil {
+		return fmt.Errorf("error updating idempotencyt: %v", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey gives up key, so that the request can be retried
+// with it.
+func ReleaseIdempotencyKey(db *sql.DB, key string) error {
+	_, err := db.Exec("DELETE FROM idempotencyt WHERE key=$1", key)
+	if err != nil {
+		return fmt.Errorf("error deleting from idempotencyt: %v", err)
+	}
+	return nil
+}
+
+// ExpireIdempotencyKeysPeriodically forgets the outcomes older than
+// IDEMPOTENCY_WINDOW every IDEMPOTENCY_EXPIRE_INTERVAL.
+func ExpireIdempotencyKeysPeriodically(db *sql.DB) {
+	for {
+		_, err := db.Exec("DELETE FROM idempotencyt WHERE created_at < NOW() - make_interval(secs => $1)",
+			GetEnvDuration("IDEMPOTENCY_WINDOW", IDEMPOTENCY_WINDOW).Seconds())
 		if err != nil {
-			return nil, fmt.Errorf("error marshaling JSON: %v", err)
+			log.Printf("Error expiring idempotency keys: %v\n", err)
 		}
+		time.Sleep(IDEMPOTENCY_EXPIRE_INTERVAL)
+	}
+}
 
-		_, err = http.Post(SHARD_MANAGER_URL+"/primary_elect", "application/json", bytes.NewBuffer(payloadData))
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v\n", key, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// ReplaceShardReplica moves the replica of shardID held by downServerID onto
+// newServerID. The new server loads a snapshot from a live replica and
+// replays the WAL after it before joining the ring, so it never serves or
+// receives writes while missing earlier ones.
+func ReplaceShardReplica(db *sql.DB, shardID string, downServerID int, newServerID int, shardTConfig ShardTConfig) (bool, error) {
+	shardTConfig.Mutex.Lock()
+	defer shardTConfig.Mutex.Unlock()
+
+	shardTConfig.CHM.RemoveServer(downServerID)
+
+	isPrimary := false
+	row := db.QueryRow("SELECT is_primary FROM mapt WHERE shard_id=$1 AND server_id=$2", shardID, downServerID)
+	err := row.Scan(&isPrimary)
+	if err != nil {
+		return false, fmt.Errorf("error scanning row: %v", err)
+	}
+
+	sourceServerID, err := GetPrimaryServerIDForShard(db, shardID)
+	if err != nil {
+		return false, err
+	}
+	if sourceServerID == -1 || sourceServerID == downServerID {
+		sourceServerID = shardTConfig.CHM.GetServerForRequest(GetRandomID())
+	}
+
+	snapshot, err := GetServerSnapshot(sourceServerID, shardID)
+	if err != nil {
+		return false, err
+	}
+
+	err = LoadServerSnapshot(newServerID, snapshot)
+	if err != nil {
+		return false, err
+	}
+
+	lsn := snapshot.LSN
+	caughtUp := false
+	for round := 0; round < CATCH_UP_MAX_ROUNDS; round++ {
+		catchUp, err := CatchUpServer(newServerID, sourceServerID, shardID)
 		if err != nil {
-			return nil, fmt.Errorf("error electing primary: %v", err)
+			return false, err
+		}
+		lsn = catchUp.LSN
+		if catchUp.Records == 0 {
+			caughtUp = true
+			break
 		}
 	}
+	if !caughtUp {
+		return false, fmt.Errorf("server %d did not catch up on shard %s from server %d", newServerID, shardID, sourceServerID)
+	}
+	log.Printf("Server%d restored shard %s from Server%d up to LSN %d\n", newServerID, shardID, sourceServerID, lsn)
 
-	newServerIDs := []int{}
-	for _, serverID := range serverIDs {
-		if serverID != downServerID {
-			newServerIDs = append(newServerIDs, serverID)
+	_, err = db.Exec("UPDATE mapt SET server_id=$1, is_primary=FALSE WHERE shard_id=$2 AND server_id=$3", newServerID, shardID, downServerID)
+	if err != nil {
+		return false, fmt.Errorf("error updating mapt: %v", err)
+	}
+
+	shardTConfig.CHM.AddServer(newServerID)
+
+	return isPrimary, nil
+}
+
+func GetServerSnapshot(serverID int, shardID string) (ServerSnapshot, error) {
+	resp, err := http.Get("http://" + GetServerIP(fmt.Sprintf("Server%d", serverID)) + ":" + fmt.Sprint(SERVER_PORT) + "/snapshot?shard=" + url.QueryEscape(shardID))
+	if err != nil {
+		return ServerSnapshot{}, fmt.Errorf("error getting snapshot from server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerSnapshot{}, fmt.Errorf("error getting snapshot from server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var snapshot ServerSnapshot
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return ServerSnapshot{}, fmt.Errorf("error decoding snapshot: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+func LoadServerSnapshot(serverID int, snapshot ServerSnapshot) error {
+	payloadData, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	resp, err := http.Post("http://"+GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(SERVER_PORT)+"/load_snapshot", "application/json", bytes.NewBuffer(payloadData))
+	if err != nil {
+		return fmt.Errorf("error loading snapshot on server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error loading snapshot on server: %s", strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func CatchUpServer(serverID int, sourceServerID int, shardID string) (ServerCatchUpResponse, error) {
+	payload := ServerCatchUpPayload{
+		Shard:  shardID,
+		Source: sourceServerID,
+	}
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return ServerCatchUpResponse{}, fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	resp, err := http.Post("http://"+GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(SERVER_PORT)+"/catch_up", "application/json", bytes.NewBuffer(payloadData))
+	if err != nil {
+		return ServerCatchUpResponse{}, fmt.Errorf("error catching up server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerCatchUpResponse{}, fmt.Errorf("error catching up server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var catchUp ServerCatchUpResponse
+	err = json.NewDecoder(resp.Body).Decode(&catchUp)
+	if err != nil {
+		return ServerCatchUpResponse{}, fmt.Errorf("error decoding catch up response: %v", err)
+	}
+
+	return catchUp, nil
+}
+
+func GetServerPointInTime(serverID int, shardID string, lsn int64, timestamp string) (ServerSnapshot, error) {
+	query := url.Values{}
+	query.Set("shard", shardID)
+	if lsn > 0 {
+		query.Set("lsn", fmt.Sprint(lsn))
+	} else {
+		query.Set("timestamp", timestamp)
+	}
+
+	resp, err := http.Get("http://" + GetServerIP(fmt.Sprintf("Server%d", serverID)) + ":" + fmt.Sprint(SERVER_PORT) + "/point_in_time?" + query.Encode())
+	if err != nil {
+		return ServerSnapshot{}, fmt.Errorf("error getting point in time from server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerSnapshot{}, fmt.Errorf("error getting point in time from server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var snapshot ServerSnapshot
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return ServerSnapshot{}, fmt.Errorf("error decoding snapshot: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+func RestoreShardOnServer(serverID int, payload ServerRestorePayload) (ServerRestoreResponse, error) {
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return ServerRestoreResponse{}, fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	resp, err := http.Post("http://"+GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(SERVER_PORT)+"/restore", "application/json", bytes.NewBuffer(payloadData))
+	if err != nil {
+		return ServerRestoreResponse{}, fmt.Errorf("error restoring shard on server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerRestoreResponse{}, fmt.Errorf("error restoring shard on server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var restored ServerRestoreResponse
+	err = json.NewDecoder(resp.Body).Decode(&restored)
+	if err != nil {
+		return ServerRestoreResponse{}, fmt.Errorf("error decoding restore response: %v", err)
+	}
+
+	return restored, nil
+}
+
+// ParseChangeToken parses a change feed token of the form "sh1:12,sh2:40"
+// into the position of each shard.
+func ParseChangeToken(token string) (map[string]int64, error) {
+	positions := make(map[string]int64)
+	if token == "" {
+		return positions, nil
+	}
+
+	for _, part := range strings.Split(token, ",") {
+		shardID, rawPosition, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid change token %q", token)
+		}
+		position, err := strconv.ParseInt(rawPosition, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid change token %q", token)
 		}
+		positions[shardID] = position
 	}
-	newServerIDs = append(newServerIDs, newServerID)
+	return positions, nil
+}
 
-	return newServerIDs, nil
+// FormatChangeToken formats the position of each shard into a change feed
+// token. Session tokens share the format, with the LSN a session's writes
+// reached in each shard.
+func FormatChangeToken(positions map[string]int64) string {
+	shardIDs := make([]string, 0, len(positions))
+	for shardID := range positions {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+
+	parts := make([]string, len(shardIDs))
+	for i, shardID := range shardIDs {
+		parts[i] = fmt.Sprintf("%s:%d", shardID, positions[shardID])
+	}
+	return strings.Join(parts, ",")
 }
 
-func GetServerWalLength(serverID int) (int, error) {
-	resp, err := http.Get("http://" + GetServerIP(fmt.Sprintf("Server%d", serverID)) + ":" + fmt.Sprint(SERVER_PORT) + "/wal_length")
+// FollowShardChanges relays the change feed of shardID from its primary, or
+// any replica if it has none, into events until ctx is done. When the
+// connection drops it reconnects after the last position relayed. A negative
+// from starts at the end of the shard's WAL. An error event from the server
+// is relayed and ends the feed.
+func FollowShardChanges(ctx context.Context, db *sql.DB, shardID string, from int64, low string, high string, events chan<- ShardChangeEvent) {
+	position := from
+	for ctx.Err() == nil {
+		err := followShardChangesOnce(ctx, db, shardID, &position, low, high, events)
+		if errors.Is(err, errChangeFeedEnded) {
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Change feed of shard %s interrupted: %v\n", shardID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(CHANGE_FEED_RETRY_INTERVAL):
+		}
+	}
+}
+
+var errChangeFeedEnded = errors.New("change feed ended")
+
+func followShardChangesOnce(ctx context.Context, db *sql.DB, shardID string, position *int64, low string, high string, events chan<- ShardChangeEvent) error {
+	serverID, err := GetPrimaryServerIDForShard(db, shardID)
 	if err != nil {
-		return -1, fmt.Errorf("error getting WAL length from Server: %v", err)
+		return err
+	}
+	if serverID == -1 {
+		serverIDs, err := GetServerIDsForShard(db, shardID)
+		if err != nil {
+			return err
+		}
+		if len(serverIDs) == 0 {
+			return fmt.Errorf("no servers found for shard %s", shardID)
+		}
+		serverID = serverIDs[0]
+	}
+
+	query := url.Values{}
+	query.Set("shard", shardID)
+	if *position >= 0 {
+		query.Set("from", fmt.Sprint(*position))
+	}
+	if low != "" {
+		query.Set("low", low)
+	}
+	if high != "" {
+		query.Set("high", high)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+GetServerIP(fmt.Sprintf("Server%d", serverID))+":"+fmt.Sprint(SERVER_PORT)+"/changes?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return -1, fmt.Errorf("error reading response body: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		data, _ := json.Marshal(strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusBadRequest {
+			sendChangeEvent(ctx, events, ShardChangeEvent{Shard: shardID, Event: "error", Data: string(data)})
+			return errChangeFeedEnded
+		}
+		return fmt.Errorf("error opening change feed: %s", strings.TrimSpace(string(body)))
 	}
 
-	var walLength int
-	json.Unmarshal(body, &walLength)
-	resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	event := ShardChangeEvent{Shard: shardID, Position: -1}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.Data == "" {
+				continue
+			}
+			if !sendChangeEvent(ctx, events, event) {
+				return nil
+			}
+			if event.Event == "error" {
+				return errChangeFeedEnded
+			}
+			if event.Position >= 0 {
+				*position = event.Position
+			}
+			event = ShardChangeEvent{Shard: shardID, Position: -1}
+		case strings.HasPrefix(line, "id: "):
+			event.Position, _ = strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "event: "):
+			event.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return scanner.Err()
+}
 
-	return walLength, nil
+func sendChangeEvent(ctx context.Context, events chan<- ShardChangeEvent, event ShardChangeEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GetServerRaftStatus returns the state of shardID's Raft group as seen by
+// serverID.
+func GetServerRaftStatus(serverID int, shardID string) (ServerRaftStatus, error) {
+	resp, err := http.Get("http://" + GetServerIP(fmt.Sprintf("Server%d", serverID)) + ":" + fmt.Sprint(SERVER_PORT) + "/raft_status?shard=" + url.QueryEscape(shardID))
+	if err != nil {
+		return ServerRaftStatus{}, fmt.Errorf("error getting Raft status from server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ServerRaftStatus{}, fmt.Errorf("error getting Raft status from server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var statuses map[string]ServerRaftStatus
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+	if err != nil {
+		return ServerRaftStatus{}, fmt.Errorf("error decoding Raft status: %v", err)
+	}
+
+	status, ok := statuses[shardID]
+	if !ok {
+		return ServerRaftStatus{}, fmt.Errorf("server has no Raft node for shard %s", shardID)
+	}
+	return status, nil
+}
+
+// GetServerReplicationLag returns, for every shard serverID leads, the lag of
+// each of its secondaries.
+func GetServerReplicationLag(serverID int) (map[string]map[int]ServerReplicaLag, error) {
+	resp, err := http.Get("http://" + GetServerIP(fmt.Sprintf("Server%d", serverID)) + ":" + fmt.Sprint(SERVER_PORT) + "/replication_lag")
+	if err != nil {
+		return nil, fmt.Errorf("error getting replication lag from server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("error getting replication lag from server: %s", strings.TrimSpace(string(body)))
+	}
+
+	var lag map[string]map[int]ServerReplicaLag
+	err = json.NewDecoder(resp.Body).Decode(&lag)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding replication lag: %v", err)
+	}
+	return lag, nil
 }
@@ -0,0 +1,506 @@
+// Command galaxydb-waldump inspects and verifies the write-ahead logs of a
+// galaxydb server.
+//
+// Usage:
+//
+//	galaxydb-waldump dump   [-shard S] [-op OP] [-stud-id ID] [-since T] [-until T] PATH...
+//	galaxydb-waldump stats  [-shard S] [-op OP] [-stud-id ID] [-since T] [-until T] PATH...
+//	galaxydb-waldump verify PATH...
+//	galaxydb-waldump diff   -shard S PATH_A PATH_B
+//
+// PATH is a segment file, the WAL directory of one shard, or the WAL root of
+// a server such as /wal. Times are given in RFC 3339.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
+)
+
+// shardFiles holds the segment files of one shard's WAL directory.
+type shardFiles struct {
+	dir   string
+	files []string
+}
+
+type filter struct {
+	shard  string
+	op     string
+	studID int
+	since  time.Time
+	until  time.Time
+}
+
+type shardStats struct {
+	records        int
+	firstLSN       int64
+	lastLSN        int64
+	firstTimestamp time.Time
+	lastTimestamp  time.Time
+	ops            map[string]int
+}
+
+type studRow struct {
+	StudID int `json:"Stud_id"`
+}
+
+type recordPayload struct {
+	StudID *int            `json:"Stud_id"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	failed := false
+	switch os.Args[1] {
+	case "dump":
+		err = dumpCommand(os.Args[2:])
+	case "stats":
+		err = statsCommand(os.Args[2:])
+	case "verify":
+		failed, err = verifyCommand(os.Args[2:])
+	case "diff":
+		failed, err = diffCommand(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "galaxydb-waldump: %v\n", err)
+		os.Exit(2)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: galaxydb-waldump dump|stats|verify|diff [flags] PATH...")
+	os.Exit(2)
+}
+
+func dumpCommand(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	var f filter
+	sinceFlag, untilFlag := f.register(flags)
+	flags.Parse(args)
+	if err := f.parseTimes(*sinceFlag, *untilFlag); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	return scanPaths(flags.Args(), func(record wal.Record) error {
+		if !f.match(record) {
+			return nil
+		}
+		return encoder.Encode(record)
+	})
+}
+
+func statsCommand(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	var f filter
+	sinceFlag, untilFlag := f.register(flags)
+	flags.Parse(args)
+	if err := f.parseTimes(*sinceFlag, *untilFlag); err != nil {
+		return err
+	}
+
+	stats := make(map[string]*shardStats)
+	err := scanPaths(flags.Args(), func(record wal.Record) error {
+		if !f.match(record) {
+			return nil
+		}
+
+		s, ok := stats[record.Shard]
+		if !ok {
+			s = &shardStats{
+				firstLSN:       record.LSN,
+				firstTimestamp: record.Timestamp,
+				ops:            make(map[string]int),
+			}
+			stats[record.Shard] = s
+		}
+		s.records++
+		s.ops[record.Op]++
+		if record.LSN < s.firstLSN {
+			s.firstLSN = record.LSN
+		}
+		if record.LSN > s.lastLSN {
+			s.lastLSN = record.LSN
+		}
+		if record.Timestamp.Before(s.firstTimestamp) {
+			s.firstTimestamp = record.Timestamp
+		}
+		if record.Timestamp.After(s.lastTimestamp) {
+			s.lastTimestamp = record.Timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	shards := make([]string, 0, len(stats))
+	for shard := range stats {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARD\tRECORDS\tFIRST LSN\tLAST LSN\tFIRST TIMESTAMP\tLAST TIMESTAMP\tOPS")
+	for _, shard := range shards {
+		s := stats[shard]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\n", shard, s.records, s.firstLSN, s.lastLSN,
+			s.firstTimestamp.Format(time.RFC3339Nano), s.lastTimestamp.Format(time.RFC3339Nano), formatOps(s.ops))
+	}
+	return w.Flush()
+}
+
+// verifyCommand checks every segment under the given paths for torn or
+// corrupt records, records of other shards and gaps in the LSN sequence.
+func verifyCommand(args []string) (bool, error) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return false, errors.New("no WAL path given")
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		groups, err := collectSegments(path)
+		if err != nil {
+			return false, err
+		}
+
+		for _, group := range groups {
+			issues, summary, err := verifyShard(group)
+			if err != nil {
+				return false, err
+			}
+			if len(issues) == 0 {
+				fmt.Printf("OK %s: %s\n", group.dir, summary)
+				continue
+			}
+			failed = true
+			fmt.Printf("FAIL %s: %s\n", group.dir, summary)
+			for _, issue := range issues {
+				fmt.Printf("  %s\n", issue)
+			}
+		}
+	}
+
+	return failed, nil
+}
+
+func verifyShard(group shardFiles) ([]string, string, error) {
+	shard := filepath.Base(group.dir)
+	issues := []string{}
+	records := 0
+	var firstLSN, lastLSN int64
+
+	for _, file := range group.files {
+		segmentLSN, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), wal.SEGMENT_EXTENSION), 10, 64)
+
+		err := wal.ScanSegment(file, func(record wal.Record) error {
+			if record.Shard != shard {
+				issues = append(issues, fmt.Sprintf("%s: LSN %d belongs to shard %s", file, record.LSN, record.Shard))
+			}
+
+			if record.Op == wal.OP_CHECKPOINT {
+				if lastLSN == 0 {
+					lastLSN = record.LSN
+				} else if record.LSN > lastLSN {
+					issues = append(issues, fmt.Sprintf("%s: checkpoint at LSN %d is past the last record %d", file, record.LSN, lastLSN))
+				}
+				return nil
+			}
+
+			records++
+			if record.LSN < segmentLSN {
+				issues = append(issues, fmt.Sprintf("%s: LSN %d is before the segment's first LSN %d", file, record.LSN, segmentLSN))
+			}
+			if lastLSN != 0 && record.LSN != lastLSN+1 {
+				issues = append(issues, fmt.Sprintf("%s: LSN %d follows LSN %d", file, record.LSN, lastLSN))
+			}
+			if firstLSN == 0 {
+				firstLSN = record.LSN
+			}
+			lastLSN = record.LSN
+			return nil
+		})
+
+		var corruption *wal.CorruptionError
+		if errors.As(err, &corruption) {
+			issues = append(issues, corruption.Error())
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	summary := fmt.Sprintf("%d records in %d segments", records, len(group.files))
+	if records > 0 {
+		summary += fmt.Sprintf(", LSN %d-%d", firstLSN, lastLSN)
+	}
+	return issues, summary, nil
+}
+
+// diffCommand compares the records two replicas hold for one shard. LSNs
+// before the later of the two first LSNs are not reported, since each replica
+// truncates its WAL at its own checkpoints.
+func diffCommand(args []string) (bool, error) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	shard := flags.String("shard", "", "shard to compare")
+	flags.Parse(args)
+	if *shard == "" || flags.NArg() != 2 {
+		return false, errors.New("diff needs -shard and two WAL paths")
+	}
+
+	pathA, pathB := flags.Arg(0), flags.Arg(1)
+	recordsA, err := loadShard(pathA, *shard)
+	if err != nil {
+		return false, err
+	}
+	recordsB, err := loadShard(pathB, *shard)
+	if err != nil {
+		return false, err
+	}
+
+	firstA, lastA := lsnRange(recordsA)
+	firstB, lastB := lsnRange(recordsB)
+	fmt.Printf("A %s: LSN %d-%d\n", pathA, firstA, lastA)
+	fmt.Printf("B %s: LSN %d-%d\n", pathB, firstB, lastB)
+
+	from := max(firstA, firstB)
+	to := max(lastA, lastB)
+	differences := 0
+	for lsn := from; lsn <= to && lsn > 0; lsn++ {
+		a, okA := recordsA[lsn]
+		b, okB := recordsB[lsn]
+		switch {
+		case !okA && !okB:
+			continue
+		case !okB:
+			fmt.Printf("LSN %d: only in A: %s %s\n", lsn, a.Op, a.Payload)
+		case !okA:
+			fmt.Printf("LSN %d: only in B: %s %s\n", lsn, b.Op, b.Payload)
+		case a.Op != b.Op || !samePayload(a.Payload, b.Payload):
+			fmt.Printf("LSN %d: differs\n  A: %s %s\n  B: %s %s\n", lsn, a.Op, a.Payload, b.Op, b.Payload)
+		default:
+			continue
+		}
+		differences++
+	}
+
+	fmt.Printf("%d differences\n", differences)
+	return differences > 0, nil
+}
+
+// loadShard reads the operation records of shard under path, keyed by LSN.
+func loadShard(path string, shard string) (map[int64]wal.Record, error) {
+	records := make(map[int64]wal.Record)
+	err := scanPaths([]string{path}, func(record wal.Record) error {
+		if record.Shard == shard && record.Op != wal.OP_CHECKPOINT {
+			records[record.LSN] = record
+		}
+		return nil
+	})
+	return records, err
+}
+
+func lsnRange(records map[int64]wal.Record) (int64, int64) {
+	var first, last int64
+	for lsn := range records {
+		if first == 0 || lsn < first {
+			first = lsn
+		}
+		if lsn > last {
+			last = lsn
+		}
+	}
+	return first, last
+}
+
+func samePayload(a, b json.RawMessage) bool {
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, a) != nil || json.Compact(&bufB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
+
+// collectSegments resolves path to the segment files it holds, grouped by the
+// shard directory they belong to.
+func collectSegments(path string) ([]shardFiles, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []shardFiles{{dir: filepath.Dir(path), files: []string{path}}}, nil
+	}
+
+	files, err := wal.SegmentPaths(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return []shardFiles{{dir: path, files: files}}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []shardFiles{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(path, entry.Name())
+		files, err := wal.SegmentPaths(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			groups = append(groups, shardFiles{dir: dir, files: files})
+		}
+	}
+	return groups, nil
+}
+
+// scanPaths calls fn for every record under paths. A corrupt segment is
+// reported on stderr and read up to its last good record.
+func scanPaths(paths []string, fn func(wal.Record) error) error {
+	if len(paths) == 0 {
+		return errors.New("no WAL path given")
+	}
+
+	for _, path := range paths {
+		groups, err := collectSegments(path)
+		if err != nil {
+			return err
+		}
+
+		for _, group := range groups {
+			for _, file := range group.files {
+				err := wal.ScanSegment(file, fn)
+				var corruption *wal.CorruptionError
+				if errors.As(err, &corruption) {
+					fmt.Fprintf(os.Stderr, "galaxydb-waldump: %v\n", err)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *filter) register(flags *flag.FlagSet) (*string, *string) {
+	flags.StringVar(&f.shard, "shard", "", "only records of this shard")
+	flags.StringVar(&f.op, "op", "", "only records of this op")
+	flags.IntVar(&f.studID, "stud-id", -1, "only records touching this Stud_id")
+	since := flags.String("since", "", "only records at or after this time")
+	until := flags.String("until", "", "only records before this time")
+	return since, until
+}
+
+func (f *filter) parseTimes(since string, until string) error {
+	var err error
+	if since != "" {
+		f.since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return fmt.Errorf("error parsing -since: %v", err)
+		}
+	}
+	if until != "" {
+		f.until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return fmt.Errorf("error parsing -until: %v", err)
+		}
+	}
+	return nil
+}
+
+func (f *filter) match(record wal.Record) bool {
+	if f.shard != "" && record.Shard != f.shard {
+		return false
+	}
+	if f.op != "" && record.Op != f.op {
+		return false
+	}
+	if !f.since.IsZero() && record.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !record.Timestamp.Before(f.until) {
+		return false
+	}
+	if f.studID >= 0 && !touchesStudID(record, f.studID) {
+		return false
+	}
+	return true
+}
+
+// touchesStudID reports whether the record's request changes the row
+// with studID. Writes carry a list of rows, updates a single row and deletes
+// only the Stud_id.
+func touchesStudID(record wal.Record, studID int) bool {
+	var payload recordPayload
+	if err := json.Unmarshal(record.Payload, &payload); err != nil {
+		return false
+	}
+	if payload.StudID != nil && *payload.StudID == studID {
+		return true
+	}
+
+	var rows []studRow
+	if err := json.Unmarshal(payload.Data, &rows); err != nil {
+		var row studRow
+		if err := json.Unmarshal(payload.Data, &row); err != nil {
+			return false
+		}
+		rows = []studRow{row}
+	}
+	for _, row := range rows {
+		if row.StudID == studID {
+			return true
+		}
+	}
+	return false
+}
+
+func formatOps(ops map[string]int) string {
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, op := range names {
+		parts[i] = fmt.Sprintf("%s=%d", op, ops[op])
+	}
+	return strings.Join(parts, " ")
+}
@@ -1,7 +1,100 @@
 package main
 
+import "time"
+
 const (
 	LOADBALANCER_URL   = "http://galaxydb-loadbalancer:5000"
 	SHARD_MANAGER_URL  = "http://galaxydb-shard-manager:8000"
 	WAL_DIRECTORY_PATH = "/wal"
+
+	SNAPSHOT_DIRECTORY_PATH = "/snapshots"
+
+	WAL_SEGMENT_SIZE        = 4 * 1024 * 1024
+	WAL_CHECKPOINT_INTERVAL = time.Minute
+
+	// Defaults for the WAL group commit, overridable through the environment
+	// variables of the same name.
+	WAL_GROUP_COMMIT_WINDOW    = 0 * time.Millisecond
+	WAL_GROUP_COMMIT_MAX_BATCH = 64
+
+	// Number of snapshots kept per shard for point-in-time recovery,
+	// overridable through the environment variable of the same name. The WAL
+	// is kept back to the oldest of them.
+	SNAPSHOT_RETENTION = 3
+
+	// CHANGE_FEED_KEEPALIVE is how often an idle change feed sends a comment
+	// to keep its connection open.
+	CHANGE_FEED_KEEPALIVE = 15 * time.Second
+
+	// Number of replicas, the primary included, that must have a write
+	// before it succeeds, overridable through the environment variable of
+	// the same name. 0 means a majority of the shard's replicas.
+	REPLICATION_QUORUM = 0
+
+	// Default time a write waits for its replicas, overridable through the
+	// environment variable of the same name.
+	REPLICATION_TIMEOUT = 5 * time.Second
+
+	// Defaults for the Raft group of every shard, overridable through the
+	// environment variables of the same name. A follower stands for election
+	// after hearing nothing from the leader for between one and two election
+	// timeouts.
+	RAFT_HEARTBEAT_INTERVAL          = 100 * time.Millisecond
+	RAFT_ELECTION_TIMEOUT            = time.Second
+	RAFT_RPC_TIMEOUT                 = 2 * time.Second
+	RAFT_MAX_ENTRIES                 = 256
+	RAFT_MEMBERSHIP_REFRESH_INTERVAL = 5 * time.Second
+	RAFT_LEADER_REPORT_INTERVAL      = 10 * time.Second
+
+	// EPOCH_HEADER carries the epoch of the primary the load balancer sent a
+	// mutation to, which is the Raft term it was elected in. A server only
+	// accepts the mutation while it leads the shard in that very term.
+	EPOCH_HEADER = "X-Galaxy-Epoch"
+
+	// Defaults for anti-entropy, overridable through the environment
+	// variables of the same name. Every ANTI_ENTROPY_INTERVAL, followers
+	// compare a Merkle tree of each shard with the leader's, over buckets of
+	// ANTI_ENTROPY_BUCKET_WIDTH Stud_ids, and repair the buckets that differ.
+	// Trees and repairs need both replicas at the same LSN, which is retried
+	// up to ANTI_ENTROPY_ATTEMPTS times on a busy shard.
+	ANTI_ENTROPY_INTERVAL     = time.Minute
+	ANTI_ENTROPY_BUCKET_WIDTH = 64
+	ANTI_ENTROPY_ATTEMPTS     = 3
+
+	// Default time a read that must reflect a given LSN waits for this
+	// replica to apply it, overridable through the environment variable of
+	// the same name. A replica that is still behind then answers anyway, with
+	// the LSN it has applied, and the load balancer reads from the primary.
+	READ_WAIT_TIMEOUT = time.Second
+
+	// IDEMPOTENCY_KEY_HEADER carries the idempotency key a client gave a
+	// mutation, of up to MAX_IDEMPOTENCY_KEY_LENGTH bytes. Each shard applies
+	// a key once, and remembers it for IDEMPOTENCY_WINDOW, overridable
+	// through the environment variable of the same name.
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"
+	MAX_IDEMPOTENCY_KEY_LENGTH = 255
+	IDEMPOTENCY_WINDOW         = 24 * time.Hour
+
+	// SNAPSHOT_TRANSFER_TIMEOUT bounds how long a follower may take to load a
+	// snapshot from its leader.
+	SNAPSHOT_TRANSFER_TIMEOUT = time.Minute
+)
+
+const (
+	WAL_OP_WRITE  = "write"
+	WAL_OP_UPDATE = "update"
+	WAL_OP_DELETE = "delete"
+	WAL_OP_CONFIG = "config"
+
+	// The records of a transaction across shards, logged by each shard it
+	// touches as it goes through two-phase commit.
+	WAL_OP_PREPARE = "prepare"
+	WAL_OP_COMMIT  = "commit"
+	WAL_OP_ABORT   = "abort"
+)
+
+const (
+	REPLICATION_MODE_SYNC      = "sync"
+	REPLICATION_MODE_SEMI_SYNC = "semi-sync"
+	REPLICATION_MODE_ASYNC     = "async"
 )
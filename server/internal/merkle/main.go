@@ -0,0 +1,142 @@
+// Package merkle builds Merkle trees over the rows of a shard so that two
+// replicas can find the Stud_id ranges they disagree on by exchanging trees
+// instead of rows.
+//
+// Rows are grouped into buckets of BucketWidth consecutive Stud_ids, and the
+// hash of a bucket covers every row in it. Level 0 of a tree holds the hash
+// of every non-empty bucket by bucket index, and each level above holds the
+// hash of pairs of nodes of the level below, up to DEPTH levels. Empty
+// buckets and subtrees have no node, so a tree only grows with the rows.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// DEPTH is the number of levels above the buckets. Two trees are compared
+// from the top level down, only descending into the subtrees that differ.
+const DEPTH = 16
+
+// Entry is one row to be hashed, identified by its Stud_id.
+type Entry struct {
+	ID   int
+	Data []byte
+}
+
+type Tree struct {
+	BucketWidth int                `json:"bucket_width"`
+	Levels      []map[int64]string `json:"levels"`
+}
+
+// Range is the Stud_ids covered by a bucket, both bounds included.
+type Range struct {
+	Low  int `json:"low"`
+	High int `json:"high"`
+}
+
+// Build returns the tree of entries with buckets of width Stud_ids.
+func Build(width int, entries []Entry) Tree {
+	sorted := append([]Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return string(sorted[i].Data) < string(sorted[j].Data)
+	})
+
+	leaves := make(map[int64][]byte)
+	for _, entry := range sorted {
+		bucket := bucketOf(entry.ID, width)
+		hash := sha256.New()
+		hash.Write(leaves[bucket])
+		hash.Write(entry.Data)
+		leaves[bucket] = hash.Sum(nil)
+	}
+
+	tree := Tree{
+		BucketWidth: width,
+		Levels:      make([]map[int64]string, DEPTH+1),
+	}
+	level := leaves
+	for depth := 0; depth <= DEPTH; depth++ {
+		tree.Levels[depth] = make(map[int64]string, len(level))
+		for index, hash := range level {
+			tree.Levels[depth][index] = hex.EncodeToString(hash)
+		}
+		level = parentLevel(level)
+	}
+	return tree
+}
+
+// parentLevel hashes every pair of sibling nodes into their parent.
+func parentLevel(level map[int64][]byte) map[int64][]byte {
+	parents := make(map[int64][]byte)
+	for index := range level {
+		parent := index >> 1
+		if _, ok := parents[parent]; ok {
+			continue
+		}
+		hash := sha256.New()
+		hash.Write(level[parent<<1])
+		hash.Write([]byte{0})
+		hash.Write(level[parent<<1|1])
+		parents[parent] = hash.Sum(nil)
+	}
+	return parents
+}
+
+func bucketOf(id int, width int) int64 {
+	bucket := int64(id) / int64(width)
+	if id < 0 && int64(id)%int64(width) != 0 {
+		bucket--
+	}
+	return bucket
+}
+
+// Diff returns the Stud_id ranges of the buckets whose rows differ between
+// two trees, in ascending order.
+func Diff(a Tree, b Tree) ([]Range, error) {
+	if a.BucketWidth != b.BucketWidth || len(a.Levels) != len(b.Levels) || len(a.Levels) == 0 {
+		return nil, fmt.Errorf("trees of different shapes cannot be compared")
+	}
+
+	top := len(a.Levels) - 1
+	candidates := []int64{}
+	for index := range a.Levels[top] {
+		candidates = append(candidates, index)
+	}
+	for index := range b.Levels[top] {
+		if _, ok := a.Levels[top][index]; !ok {
+			candidates = append(candidates, index)
+		}
+	}
+
+	buckets := []int64{}
+	for depth := top; depth >= 0; depth-- {
+		next := []int64{}
+		for _, index := range candidates {
+			if a.Levels[depth][index] == b.Levels[depth][index] {
+				continue
+			}
+			if depth == 0 {
+				buckets = append(buckets, index)
+			} else {
+				next = append(next, index<<1, index<<1|1)
+			}
+		}
+		candidates = next
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i] < buckets[j]
+	})
+	ranges := make([]Range, 0, len(buckets))
+	for _, bucket := range buckets {
+		low := bucket * int64(a.BucketWidth)
+		ranges = append(ranges, Range{Low: int(low), High: int(low) + a.BucketWidth - 1})
+	}
+	return ranges, nil
+}
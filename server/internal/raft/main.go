@@ -0,0 +1,791 @@
+// Package raft replicates the WAL of a shard across the shard's replicas with
+// the Raft consensus algorithm. The WAL is the Raft log: the LSN of a record
+// is its index, and every record carries the term it was written in. The
+// replicas elect a leader among themselves, only the leader appends new
+// records, and a record is applied once a majority of the replicas have it.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
+)
+
+const (
+	ROLE_FOLLOWER  = "follower"
+	ROLE_CANDIDATE = "candidate"
+	ROLE_LEADER    = "leader"
+
+	// OP_NOOP is the record a new leader appends so that the records of
+	// earlier terms can be committed without waiting for a client write.
+	OP_NOOP = "noop"
+
+	// NONE stands for no vote, or for an unknown leader.
+	NONE = -1
+)
+
+var (
+	ErrNotLeader = errors.New("not the leader")
+	ErrTimeout   = errors.New("timed out waiting for replication")
+	// ErrCannotApply is wrapped by Apply for a record that will never apply,
+	// such as one that cannot be decoded.
+	ErrCannotApply = errors.New("record cannot be applied")
+)
+
+type Config struct {
+	ID        int
+	Shard     string
+	Log       *wal.Log
+	Storage   Storage
+	Transport Transport
+
+	// Members returns the IDs of every replica of the shard, this one
+	// included. A node only stands for election once it is one of them.
+	Members func() ([]int, error)
+	// Apply applies a committed record to the shard. It is called from a
+	// single goroutine in LSN order, and called again if it fails, unless
+	// the error wraps ErrCannotApply: the node then halts at that record and
+	// applies nothing more.
+	Apply func(wal.Record) error
+	// Applied is the LSN up to which the shard already reflects the log.
+	// The node starts committed up to the saved commit LSN if that is ahead.
+	Applied int64
+	// OnLeader is called when the node becomes leader, and every
+	// LeaderReportInterval while it stays leader.
+	OnLeader func(term int64)
+
+	HeartbeatInterval      time.Duration
+	ElectionTimeout        time.Duration
+	MembersRefreshInterval time.Duration
+	LeaderReportInterval   time.Duration
+	// MaxEntries caps the number of records sent in one AppendEntries.
+	MaxEntries int
+}
+
+// Progress is what the leader knows about one of its followers.
+type Progress struct {
+	MatchLSN  int64     `json:"last_acked_lsn"`
+	LastAck   time.Time `json:"last_ack_time"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type Status struct {
+	Shard      string `json:"shard"`
+	Role       string `json:"role"`
+	Term       int64  `json:"term"`
+	Leader     int    `json:"leader"`
+	LastLSN    int64  `json:"last_lsn"`
+	CommitLSN  int64  `json:"commit_lsn"`
+	AppliedLSN int64  `json:"applied_lsn"`
+	// HaltedLSN is the record the node halted at, and HaltError why it
+	// cannot be applied.
+	HaltedLSN int64  `json:"halted_lsn,omitempty"`
+	HaltError string `json:"halt_error,omitempty"`
+}
+
+// Node is the member of a shard's Raft group that runs on this server.
+type Node struct {
+	config Config
+
+	mutex           sync.Mutex
+	role            string
+	term            int64
+	votedFor        int
+	leader          int
+	peers           []int
+	member          bool
+	commitLSN       int64
+	appliedLSN      int64
+	lastContact     time.Time
+	electionTimeout time.Duration
+	reportedAt      time.Time
+
+	// haltedLSN is the record that failed with ErrCannotApply, and haltErr
+	// its error, once the node has halted.
+	haltedLSN int64
+	haltErr   error
+
+	// Replication state of the leader, per follower.
+	progress  map[int]*Progress
+	nextLSN   map[int]int64
+	triggers  map[int]chan struct{}
+	peerStops map[int]chan struct{}
+
+	// changed is closed and replaced whenever the role, commit or applied
+	// LSN, or the progress of a follower changes.
+	changed chan struct{}
+
+	// savedCommit is the commit LSN last saved to the storage. Only the
+	// applier uses it, under applyMutex.
+	savedCommit int64
+
+	// appendMutex serializes the changes made to the log, so that records
+	// proposed by a leader that is being deposed never interleave with the
+	// records of the new leader. applyMutex serializes the changes made to
+	// the shard.
+	appendMutex sync.Mutex
+	applyMutex  sync.Mutex
+}
+
+// New creates the node of a shard from its persisted term, vote and commit
+// LSN. It does nothing until it is started.
+func New(config Config) (*Node, error) {
+	term, votedFor, err := config.Storage.LoadState(config.Shard)
+	if err != nil {
+		return nil, fmt.Errorf("error loading Raft state of shard %s: %w", config.Shard, err)
+	}
+	commit, err := config.Storage.LoadCommit(config.Shard)
+	if err != nil {
+		return nil, fmt.Errorf("error loading commit LSN of shard %s: %w", config.Shard, err)
+	}
+	commit = max(min(commit, config.Log.LastLSN()), config.Applied)
+
+	n := &Node{
+		config:      config,
+		role:        ROLE_FOLLOWER,
+		term:        term,
+		votedFor:    votedFor,
+		leader:      NONE,
+		commitLSN:   commit,
+		appliedLSN:  config.Applied,
+		savedCommit: commit,
+		lastContact: time.Now(),
+		changed:     make(chan struct{}),
+	}
+	n.electionTimeout = n.randomElectionTimeout()
+	return n, nil
+}
+
+// Start runs the node's election timer and applies committed records in the
+// background.
+func (n *Node) Start() {
+	go n.run()
+	go n.applyCommitted()
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	n.refreshMembers()
+	refreshed := time.Now()
+
+	for range ticker.C {
+		if time.Since(refreshed) >= n.config.MembersRefreshInterval {
+			n.refreshMembers()
+			refreshed = time.Now()
+		}
+
+		n.mutex.Lock()
+		electionDue := n.role != ROLE_LEADER && n.member && time.Since(n.lastContact) >= n.electionTimeout
+		if n.role == ROLE_LEADER && time.Since(n.reportedAt) >= n.config.LeaderReportInterval {
+			n.reportedAt = time.Now()
+			go n.config.OnLeader(n.term)
+		}
+		n.mutex.Unlock()
+
+		if electionDue {
+			n.campaign()
+		}
+	}
+}
+
+func (n *Node) randomElectionTimeout() time.Duration {
+	return n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+}
+
+func (n *Node) refreshMembers() {
+	members, err := n.config.Members()
+	if err != nil {
+		log.Printf("Error getting the members of shard %s: %v\n", n.config.Shard, err)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.member = false
+	peers := []int{}
+	for _, member := range members {
+		if member == n.config.ID {
+			n.member = true
+		} else {
+			peers = append(peers, member)
+		}
+	}
+	n.peers = peers
+
+	if n.role != ROLE_LEADER {
+		return
+	}
+	if !n.member {
+		n.stepDown(n.term)
+		return
+	}
+
+	next := n.config.Log.LastLSN() + 1
+	current := make(map[int]bool, len(peers))
+	for _, peer := range peers {
+		current[peer] = true
+		if _, ok := n.peerStops[peer]; !ok {
+			n.startPeer(peer, next)
+		}
+	}
+	for peer, stop := range n.peerStops {
+		if !current[peer] {
+			close(stop)
+			delete(n.peerStops, peer)
+			delete(n.triggers, peer)
+			delete(n.nextLSN, peer)
+			delete(n.progress, peer)
+		}
+	}
+	n.advanceCommit()
+}
+
+// quorum returns how many members, this one included, make a majority.
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) broadcast() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// campaign stands for election in the next term.
+func (n *Node) campaign() {
+	n.refreshMembers()
+
+	n.mutex.Lock()
+	if n.role == ROLE_LEADER || !n.member {
+		n.mutex.Unlock()
+		return
+	}
+
+	term := n.term + 1
+	n.lastContact = time.Now()
+	n.electionTimeout = n.randomElectionTimeout()
+	if err := n.config.Storage.SaveState(n.config.Shard, term, n.config.ID); err != nil {
+		log.Printf("Error saving Raft state of shard %s: %v\n", n.config.Shard, err)
+		n.mutex.Unlock()
+		return
+	}
+	n.term = term
+	n.votedFor = n.config.ID
+	n.role = ROLE_CANDIDATE
+	n.leader = NONE
+	n.broadcast()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		n.mutex.Unlock()
+		return
+	}
+
+	peers := append([]int(nil), n.peers...)
+	lastLSN, lastTerm := n.config.Log.Last()
+	n.mutex.Unlock()
+
+	request := VoteRequest{
+		Shard:     n.config.Shard,
+		Term:      term,
+		Candidate: n.config.ID,
+		LastLSN:   lastLSN,
+		LastTerm:  lastTerm,
+	}
+	responses := make(chan VoteResponse, len(peers))
+	for _, peer := range peers {
+		go func(peer int) {
+			response, err := n.config.Transport.RequestVote(peer, request)
+			if err != nil {
+				response = VoteResponse{}
+			}
+			responses <- response
+		}(peer)
+	}
+
+	for range peers {
+		response := <-responses
+
+		n.mutex.Lock()
+		if response.Term > n.term {
+			n.stepDown(response.Term)
+		}
+		if n.role != ROLE_CANDIDATE || n.term != term {
+			n.mutex.Unlock()
+			return
+		}
+		if response.Granted {
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+				n.mutex.Unlock()
+				return
+			}
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// stepDown makes the node a follower, in a new term if term is ahead of its
+// own. The caller holds the mutex.
+func (n *Node) stepDown(term int64) {
+	if term > n.term {
+		if err := n.config.Storage.SaveState(n.config.Shard, term, NONE); err != nil {
+			log.Printf("Error saving Raft state of shard %s: %v\n", n.config.Shard, err)
+		}
+		n.term = term
+		n.votedFor = NONE
+		n.leader = NONE
+	}
+
+	if n.role == ROLE_LEADER {
+		for _, stop := range n.peerStops {
+			close(stop)
+		}
+		n.peerStops = nil
+		n.triggers = nil
+		log.Printf("Server%d steps down as the leader of shard %s in term %d\n", n.config.ID, n.config.Shard, n.term)
+	}
+	n.role = ROLE_FOLLOWER
+	n.broadcast()
+}
+
+// follow records a message from the leader of term. The caller holds the
+// mutex.
+func (n *Node) follow(term int64, leader int) {
+	if term > n.term || n.role != ROLE_FOLLOWER {
+		n.stepDown(term)
+	}
+	n.leader = leader
+	n.lastContact = time.Now()
+}
+
+// becomeLeader starts replicating to every follower. The caller holds the
+// mutex.
+func (n *Node) becomeLeader() {
+	n.role = ROLE_LEADER
+	n.leader = n.config.ID
+	n.progress = make(map[int]*Progress)
+	n.nextLSN = make(map[int]int64)
+	n.triggers = make(map[int]chan struct{})
+	n.peerStops = make(map[int]chan struct{})
+
+	next := n.config.Log.LastLSN() + 1
+	for _, peer := range n.peers {
+		n.startPeer(peer, next)
+	}
+
+	term := n.term
+	n.reportedAt = time.Now()
+	go n.config.OnLeader(term)
+	go func() {
+		if _, err := n.propose(term, OP_NOOP, "", nil); err != nil {
+			log.Printf("Error appending no-op to shard %s in term %d: %v\n", n.config.Shard, term, err)
+		}
+	}()
+
+	n.broadcast()
+	log.Printf("Server%d is the leader of shard %s in term %d\n", n.config.ID, n.config.Shard, term)
+}
+
+// Propose appends a record for op to the leader's log in term and starts
+// replicating it. It fails with ErrNotLeader unless the node leads term, or
+// leads any term if term is 0, so that a caller holding a fencing token from
+// an earlier election cannot write through a later one. The record is not
+// committed yet when Propose returns; WaitFor waits for that.
+func (n *Node) Propose(term int64, op string, key string, payload []byte) (wal.Record, error) {
+	n.mutex.Lock()
+	if n.role != ROLE_LEADER || (term != 0 && term != n.term) {
+		n.mutex.Unlock()
+		return wal.Record{}, ErrNotLeader
+	}
+	term = n.term
+	n.mutex.Unlock()
+
+	return n.propose(term, op, key, payload)
+}
+
+func (n *Node) propose(term int64, op string, key string, payload []byte) (wal.Record, error) {
+	n.appendMutex.Lock()
+	n.mutex.Lock()
+	if n.role != ROLE_LEADER || n.term != term {
+		n.mutex.Unlock()
+		n.appendMutex.Unlock()
+		return wal.Record{}, ErrNotLeader
+	}
+	n.mutex.Unlock()
+
+	record, err := n.config.Log.Append(term, op, key, payload)
+	n.appendMutex.Unlock()
+	if err != nil {
+		return wal.Record{}, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.role == ROLE_LEADER && n.term == term {
+		n.advanceCommit()
+		for _, trigger := range n.triggers {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return record, nil
+}
+
+// WaitFor waits until the record is committed and applied, and at least
+// replicas members, the leader included, have it. The record applied at its
+// LSN must be the one proposed: a new leader may have replaced it with its
+// own, which fails with ErrNotLeader. It fails with the node's halt error
+// right away once the node has halted before the record.
+func (n *Node) WaitFor(record wal.Record, replicas int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		n.mutex.Lock()
+		applied := n.appliedLSN >= record.LSN
+		if applied {
+			if term, ok := n.config.Log.TermAt(record.LSN); !ok || term != record.Term {
+				n.mutex.Unlock()
+				return fmt.Errorf("%w: LSN %d of shard %s was replaced by a later leader", ErrNotLeader, record.LSN, n.config.Shard)
+			}
+		}
+		if !applied && n.haltErr != nil {
+			err := n.haltErr
+			n.mutex.Unlock()
+			return err
+		}
+		if applied && n.role == ROLE_LEADER && n.acked(record.LSN) >= replicas {
+			n.mutex.Unlock()
+			return nil
+		}
+		if n.role != ROLE_LEADER || n.term != record.Term {
+			n.mutex.Unlock()
+			if applied {
+				return nil
+			}
+			return fmt.Errorf("%w: lost the leadership of shard %s before LSN %d was committed", ErrNotLeader, n.config.Shard, record.LSN)
+		}
+		changed := n.changed
+		n.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%w: LSN %d of shard %s", ErrTimeout, record.LSN, n.config.Shard)
+		}
+	}
+}
+
+// acked returns how many members have the record at lsn. The caller holds
+// the mutex.
+func (n *Node) acked(lsn int64) int {
+	acks := 1
+	for _, peer := range n.peers {
+		if progress, ok := n.progress[peer]; ok && progress.MatchLSN >= lsn {
+			acks++
+		}
+	}
+	return acks
+}
+
+// advanceCommit commits the records of the current term that a majority of
+// the members have. The caller holds the mutex.
+func (n *Node) advanceCommit() {
+	if n.role != ROLE_LEADER {
+		return
+	}
+
+	matches := []int64{n.config.Log.LastLSN()}
+	for _, peer := range n.peers {
+		if progress, ok := n.progress[peer]; ok {
+			matches = append(matches, progress.MatchLSN)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i] > matches[j]
+	})
+
+	commit := matches[n.quorum()-1]
+	if commit <= n.commitLSN {
+		return
+	}
+	if term, ok := n.config.Log.TermAt(commit); !ok || term != n.term {
+		return
+	}
+	n.commitLSN = commit
+	n.broadcast()
+}
+
+// HandleVote answers a candidate's request for a vote.
+func (n *Node) HandleVote(request VoteRequest) VoteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if request.Term < n.term {
+		return VoteResponse{Term: n.term}
+	}
+	if request.Term > n.term {
+		n.stepDown(request.Term)
+	}
+
+	lastLSN, lastTerm := n.config.Log.Last()
+	upToDate := request.LastTerm > lastTerm || (request.LastTerm == lastTerm && request.LastLSN >= lastLSN)
+	if !upToDate || (n.votedFor != NONE && n.votedFor != request.Candidate) {
+		return VoteResponse{Term: n.term}
+	}
+
+	if err := n.config.Storage.SaveState(n.config.Shard, n.term, request.Candidate); err != nil {
+		log.Printf("Error saving Raft state of shard %s: %v\n", n.config.Shard, err)
+		return VoteResponse{Term: n.term}
+	}
+	n.votedFor = request.Candidate
+	n.lastContact = time.Now()
+	return VoteResponse{Term: n.term, Granted: true}
+}
+
+// HandleAppend appends the leader's records after the last record both logs
+// agree on, discarding any of its own records that conflict with them.
+// Records up to the commit LSN are committed and so agree without checking.
+func (n *Node) HandleAppend(request AppendRequest) AppendResponse {
+	n.mutex.Lock()
+	if request.Term < n.term {
+		defer n.mutex.Unlock()
+		return AppendResponse{Term: n.term}
+	}
+	n.follow(request.Term, request.Leader)
+	term := n.term
+	commit := n.commitLSN
+	n.mutex.Unlock()
+
+	n.appendMutex.Lock()
+	defer n.appendMutex.Unlock()
+
+	shardLog := n.config.Log
+	lastLSN := shardLog.LastLSN()
+	if request.PrevLSN > lastLSN {
+		return AppendResponse{Term: term, LastLSN: lastLSN}
+	}
+	if request.PrevLSN > commit {
+		if prevTerm, ok := shardLog.TermAt(request.PrevLSN); !ok || prevTerm != request.PrevTerm {
+			return AppendResponse{Term: term, LastLSN: request.PrevLSN - 1}
+		}
+	}
+
+	entries := request.Entries
+	for len(entries) != 0 && entries[0].LSN <= lastLSN {
+		entry := entries[0]
+		if entry.LSN > commit {
+			if entryTerm, ok := shardLog.TermAt(entry.LSN); !ok || entryTerm != entry.Term {
+				if err := shardLog.TruncateAfter(entry.LSN - 1); err != nil {
+					log.Printf("Error discarding conflicting WAL records of shard %s: %v\n", n.config.Shard, err)
+					return AppendResponse{Term: term, LastLSN: shardLog.LastLSN()}
+				}
+				break
+			}
+		}
+		entries = entries[1:]
+	}
+	if len(entries) != 0 {
+		if err := shardLog.AppendRecords(entries); err != nil {
+			log.Printf("Error appending WAL records of shard %s: %v\n", n.config.Shard, err)
+			return AppendResponse{Term: term, LastLSN: shardLog.LastLSN()}
+		}
+	}
+
+	match := request.PrevLSN + int64(len(request.Entries))
+	n.mutex.Lock()
+	if n.term == term {
+		if commit := min(request.CommitLSN, match); commit > n.commitLSN {
+			n.commitLSN = commit
+			n.broadcast()
+		}
+	}
+	n.mutex.Unlock()
+
+	return AppendResponse{Term: term, Success: true, LastLSN: match}
+}
+
+// HandleSnapshot has the follower replace its shard with the leader's, using
+// load, when the leader no longer retains the records the follower needs.
+func (n *Node) HandleSnapshot(request SnapshotRequest, load func() error) (SnapshotResponse, error) {
+	n.mutex.Lock()
+	if request.Term < n.term {
+		defer n.mutex.Unlock()
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	n.follow(request.Term, request.Leader)
+	term := n.term
+	n.mutex.Unlock()
+
+	if err := load(); err != nil {
+		return SnapshotResponse{}, err
+	}
+
+	n.mutex.Lock()
+	n.lastContact = time.Now()
+	n.mutex.Unlock()
+	return SnapshotResponse{Term: term, LastLSN: n.config.Log.LastLSN()}, nil
+}
+
+// Install runs fn, which changes the log and the shard outside of Raft, such
+// as loading a snapshot, and returns the LSN the shard reflects after it.
+// Records are neither appended nor applied by the node meanwhile.
+func (n *Node) Install(fn func() (int64, error)) error {
+	n.appendMutex.Lock()
+	defer n.appendMutex.Unlock()
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	applied, err := fn()
+	if err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.appliedLSN = applied
+	if applied > n.commitLSN {
+		n.commitLSN = applied
+	}
+	n.broadcast()
+	return nil
+}
+
+// applyCommitted applies committed records to the shard as they are
+// committed, until a record cannot be applied.
+func (n *Node) applyCommitted() {
+	for {
+		n.mutex.Lock()
+		changed := n.changed
+		n.mutex.Unlock()
+
+		progressed, err := n.applyRange()
+		if errors.Is(err, ErrCannotApply) {
+			log.Printf("Halting WAL of shard %s: %v\n", n.config.Shard, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Error applying WAL of shard %s: %v\n", n.config.Shard, err)
+			time.Sleep(n.config.HeartbeatInterval)
+			continue
+		}
+		if !progressed {
+			<-changed
+		}
+	}
+}
+
+// applyRange applies the committed records that are not applied yet and
+// reports whether it applied any. The commit LSN is saved before them, so
+// that a restarted node can apply them again without a leader.
+func (n *Node) applyRange() (bool, error) {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	from := n.appliedLSN + 1
+	commit := n.commitLSN
+	n.mutex.Unlock()
+	if from > commit {
+		return false, nil
+	}
+	if commit > n.savedCommit {
+		if err := n.config.Storage.SaveCommit(n.config.Shard, commit); err != nil {
+			return false, fmt.Errorf("error saving commit LSN %d: %w", commit, err)
+		}
+		n.savedCommit = commit
+	}
+
+	errDone := errors.New("done")
+	progressed := false
+	err := n.config.Log.ReadFrom(from, func(record wal.Record) error {
+		if record.LSN > commit {
+			return errDone
+		}
+		if err := n.config.Apply(record); err != nil {
+			err = fmt.Errorf("error applying LSN %d: %w", record.LSN, err)
+			if errors.Is(err, ErrCannotApply) {
+				n.mutex.Lock()
+				n.haltedLSN = record.LSN
+				n.haltErr = err
+				n.broadcast()
+				n.mutex.Unlock()
+			}
+			return err
+		}
+
+		n.mutex.Lock()
+		n.appliedLSN = record.LSN
+		n.broadcast()
+		n.mutex.Unlock()
+		progressed = true
+		return nil
+	})
+	if errors.Is(err, errDone) {
+		err = nil
+	}
+	return progressed, err
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	haltError := ""
+	if n.haltErr != nil {
+		haltError = n.haltErr.Error()
+	}
+	return Status{
+		Shard:      n.config.Shard,
+		Role:       n.role,
+		Term:       n.term,
+		Leader:     n.leader,
+		LastLSN:    n.config.Log.LastLSN(),
+		CommitLSN:  n.commitLSN,
+		AppliedLSN: n.appliedLSN,
+		HaltedLSN:  n.haltedLSN,
+		HaltError:  haltError,
+	}
+}
+
+// Progress returns the progress of every follower while the node is the
+// leader, and nothing otherwise.
+func (n *Node) Progress() map[int]Progress {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	progress := make(map[int]Progress)
+	if n.role != ROLE_LEADER {
+		return progress
+	}
+	for peer, p := range n.progress {
+		progress[peer] = *p
+	}
+	return progress
+}
+
+// Applied returns the LSN up to which the shard reflects the log, and a
+// channel that is closed once that changes.
+func (n *Node) Applied() (int64, <-chan struct{}) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.appliedLSN, n.changed
+}
@@ -0,0 +1,535 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
+)
+
+func TestLeaderChangeReplacesUncommittedRecord(t *testing.T) {
+	network, nodes := newCluster(t, 1, 2, 3)
+
+	var leader int
+	eventually(t, "a leader whose no-op every node applied", func() bool {
+		leader = leaderOf(nodes)
+		for _, node := range nodes {
+			if node.Status().AppliedLSN < 1 {
+				return false
+			}
+		}
+		return leader != NONE
+	})
+
+	// Cut the leader off, so that only it gets the record it proposes.
+	network.isolate(leader)
+	record, err := nodes[leader].Propose(0, "write", "request-1", []byte(`{"data":[]}`))
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- nodes[leader].WaitFor(record, 1, 10*time.Second)
+	}()
+
+	eventually(t, "the other nodes to commit a record of a later term at the proposed LSN", func() bool {
+		for id, node := range nodes {
+			status := node.Status()
+			if id != leader && (status.Term <= record.Term || status.AppliedLSN < record.LSN) {
+				return false
+			}
+		}
+		return true
+	})
+
+	network.heal(leader)
+	eventually(t, "the old leader to follow and apply the new leader's records", func() bool {
+		status := nodes[leader].Status()
+		return status.Role == ROLE_FOLLOWER && status.AppliedLSN >= record.LSN
+	})
+
+	if term, ok := nodes[leader].config.Log.TermAt(record.LSN); !ok || term == record.Term {
+		t.Errorf("the old leader's record at LSN %d is in term %d, %v, want it replaced", record.LSN, term, ok)
+	}
+	if err := <-waiting; !errors.Is(err, ErrNotLeader) {
+		t.Errorf("WaitFor while the record was replaced returned %v, want ErrNotLeader", err)
+	}
+	if err := nodes[leader].WaitFor(record, 1, time.Second); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("WaitFor after the record was replaced returned %v, want ErrNotLeader", err)
+	}
+}
+
+func TestHaltsAtRecordThatCannotApply(t *testing.T) {
+	network := &memoryNetwork{nodes: make(map[int]*Node), isolated: make(map[int]bool)}
+	node := newNode(t, 1, network, nil)
+	network.nodes[1] = node
+
+	var mutex sync.Mutex
+	attempts := 0
+	node.config.Apply = func(record wal.Record) error {
+		if record.Op != "bad" {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		return fmt.Errorf("%w: bad record", ErrCannotApply)
+	}
+	node.Start()
+
+	eventually(t, "the node to lead", func() bool {
+		return node.Status().Role == ROLE_LEADER
+	})
+	bad, err := node.Propose(0, "bad", "", nil)
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	if err := node.WaitFor(bad, 1, 10*time.Second); !errors.Is(err, ErrCannotApply) {
+		t.Fatalf("WaitFor of the bad record returned %v, want ErrCannotApply", err)
+	}
+
+	next, err := node.Propose(0, "write", "", nil)
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	start := time.Now()
+	if err := node.WaitFor(next, 1, 10*time.Second); !errors.Is(err, ErrCannotApply) {
+		t.Errorf("WaitFor of a later record returned %v, want ErrCannotApply", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("WaitFor of a later record took %v", waited)
+	}
+
+	time.Sleep(10 * node.config.HeartbeatInterval)
+	status := node.Status()
+	if status.HaltedLSN != bad.LSN || status.HaltError == "" || status.AppliedLSN != bad.LSN-1 {
+		t.Errorf("status is %+v, want halted at LSN %d with an error", status, bad.LSN)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 1 {
+		t.Errorf("applied the bad record %d times, want once", attempts)
+	}
+}
+
+func TestHandleAppend(t *testing.T) {
+	tests := []struct {
+		name string
+		// terms are the terms of the follower's records from LSN 1 on.
+		terms    []int64
+		nodeTerm int64
+		request  AppendRequest
+		want     AppendResponse
+		// wantTerms are the terms of the follower's records afterwards.
+		wantTerms []int64
+	}{
+		{
+			name:      "appends after the matching record",
+			terms:     []int64{1, 1},
+			request:   AppendRequest{Term: 2, PrevLSN: 2, PrevTerm: 1, Entries: entries(3, 2)},
+			want:      AppendResponse{Term: 2, Success: true, LastLSN: 3},
+			wantTerms: []int64{1, 1, 2},
+		},
+		{
+			name:      "heartbeat",
+			terms:     []int64{1, 1},
+			request:   AppendRequest{Term: 2, PrevLSN: 2, PrevTerm: 1},
+			want:      AppendResponse{Term: 2, Success: true, LastLSN: 2},
+			wantTerms: []int64{1, 1},
+		},
+		{
+			name:      "rejects a missing previous record",
+			terms:     []int64{1},
+			request:   AppendRequest{Term: 2, PrevLSN: 3, PrevTerm: 1, Entries: entries(4, 2)},
+			want:      AppendResponse{Term: 2, LastLSN: 1},
+			wantTerms: []int64{1},
+		},
+		{
+			name:      "rejects a previous record of another term",
+			terms:     []int64{1, 1, 2},
+			request:   AppendRequest{Term: 3, PrevLSN: 3, PrevTerm: 3, Entries: entries(4, 3)},
+			want:      AppendResponse{Term: 3, LastLSN: 2},
+			wantTerms: []int64{1, 1, 2},
+		},
+		{
+			name:      "truncates conflicting records",
+			terms:     []int64{1, 1, 1},
+			request:   AppendRequest{Term: 2, PrevLSN: 1, PrevTerm: 1, Entries: entries(2, 2, 2)},
+			want:      AppendResponse{Term: 2, Success: true, LastLSN: 3},
+			wantTerms: []int64{1, 2, 2},
+		},
+		{
+			name:      "truncates conflicting records past the leader's",
+			terms:     []int64{1, 2, 2, 2},
+			request:   AppendRequest{Term: 3, PrevLSN: 1, PrevTerm: 1, Entries: entries(2, 3)},
+			want:      AppendResponse{Term: 3, Success: true, LastLSN: 2},
+			wantTerms: []int64{1, 3},
+		},
+		{
+			name:      "keeps records after matching ones",
+			terms:     []int64{1, 1, 1},
+			request:   AppendRequest{Term: 1, PrevLSN: 0, PrevTerm: 0, Entries: entries(1, 1, 1)},
+			want:      AppendResponse{Term: 1, Success: true, LastLSN: 2},
+			wantTerms: []int64{1, 1, 1},
+		},
+		{
+			name:      "rejects a leader of an earlier term",
+			terms:     []int64{1, 1},
+			nodeTerm:  3,
+			request:   AppendRequest{Term: 2, PrevLSN: 2, PrevTerm: 1, Entries: entries(3, 2)},
+			want:      AppendResponse{Term: 3},
+			wantTerms: []int64{1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newNode(t, 1, nil, test.terms)
+			node.term = test.nodeTerm
+			test.request.Shard = "sh1"
+			test.request.Leader = 2
+
+			response := node.HandleAppend(test.request)
+			if response != test.want {
+				t.Errorf("HandleAppend returned %+v, want %+v", response, test.want)
+			}
+			if terms := termsOf(node.config.Log); !reflect.DeepEqual(terms, test.wantTerms) {
+				t.Errorf("log holds terms %v, want %v", terms, test.wantTerms)
+			}
+		})
+	}
+}
+
+func TestAdvanceCommit(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []int64
+		term  int64
+		// matches are the last LSNs followers 2 and 3 are known to have.
+		matches map[int]int64
+		commit  int64
+		want    int64
+	}{
+		{
+			name:    "majority of an earlier term",
+			terms:   []int64{2, 2},
+			term:    3,
+			matches: map[int]int64{2: 2},
+			want:    0,
+		},
+		{
+			name:    "majority of the current term",
+			terms:   []int64{2, 2, 3},
+			term:    3,
+			matches: map[int]int64{2: 3},
+			want:    3,
+		},
+		{
+			name:    "current term on a minority",
+			terms:   []int64{2, 2, 3},
+			term:    3,
+			matches: map[int]int64{2: 2, 3: 1},
+			want:    0,
+		},
+		{
+			name:    "up to the majority's match",
+			terms:   []int64{3, 3, 3, 3},
+			term:    3,
+			matches: map[int]int64{2: 3, 3: 2},
+			want:    3,
+		},
+		{
+			name:    "never moves back",
+			terms:   []int64{3, 3, 3},
+			term:    3,
+			matches: map[int]int64{2: 1, 3: 1},
+			commit:  3,
+			want:    3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newNode(t, 1, nil, test.terms)
+			node.role = ROLE_LEADER
+			node.term = test.term
+			node.peers = []int{2, 3}
+			node.progress = make(map[int]*Progress)
+			for peer, match := range test.matches {
+				node.progress[peer] = &Progress{MatchLSN: match}
+			}
+			node.commitLSN = test.commit
+
+			node.advanceCommit()
+			if node.commitLSN != test.want {
+				t.Errorf("commit LSN is %d, want %d", node.commitLSN, test.want)
+			}
+		})
+	}
+}
+
+func TestNewResumesFromSavedCommit(t *testing.T) {
+	tests := []struct {
+		name    string
+		terms   []int64
+		applied int64
+		saved   int64
+		want    int64
+	}{
+		{name: "saved commit ahead of the shard", terms: []int64{1, 1, 1, 1}, applied: 1, saved: 3, want: 3},
+		{name: "shard ahead of the saved commit", terms: []int64{1, 1, 1, 1}, applied: 2, saved: 1, want: 2},
+		{name: "saved commit past the log", terms: []int64{1, 1}, applied: 0, saved: 4, want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newNode(t, 1, nil, test.terms).config
+			config.Storage = &memoryStorage{votedFor: NONE, commit: test.saved}
+			config.Applied = test.applied
+
+			node, err := New(config)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if status := node.Status(); status.CommitLSN != test.want || status.AppliedLSN != test.applied {
+				t.Errorf("node starts committed up to %d and applied up to %d, want %d and %d",
+					status.CommitLSN, status.AppliedLSN, test.want, test.applied)
+			}
+		})
+	}
+}
+
+func TestApplyRangeSavesCommit(t *testing.T) {
+	node := newNode(t, 1, nil, []int64{1, 1, 1})
+	node.commitLSN = 2
+
+	if _, err := node.applyRange(); err != nil {
+		t.Fatalf("applyRange: %v", err)
+	}
+	if commit, _ := node.config.Storage.LoadCommit("sh1"); commit != 2 {
+		t.Errorf("saved commit LSN %d, want 2", commit)
+	}
+	if applied := node.Status().AppliedLSN; applied != 2 {
+		t.Errorf("applied up to %d, want 2", applied)
+	}
+}
+
+// memoryNetwork delivers the RPCs of a test cluster by calling the handlers
+// of the receiving node directly. A node that is isolated neither sends nor
+// receives anything.
+type memoryNetwork struct {
+	mutex    sync.RWMutex
+	nodes    map[int]*Node
+	isolated map[int]bool
+}
+
+var errUnreachable = errors.New("unreachable")
+
+func (n *memoryNetwork) deliver(from int, to int, call func(*Node)) error {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	node, ok := n.nodes[to]
+	if !ok || n.isolated[from] || n.isolated[to] {
+		return errUnreachable
+	}
+	call(node)
+	return nil
+}
+
+// isolate cuts ids off once no RPC to or from them is in flight.
+func (n *memoryNetwork) isolate(ids ...int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, id := range ids {
+		n.isolated[id] = true
+	}
+}
+
+func (n *memoryNetwork) heal(id int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.isolated, id)
+}
+
+type memoryTransport struct {
+	network *memoryNetwork
+	from    int
+}
+
+func (t memoryTransport) RequestVote(peer int, request VoteRequest) (VoteResponse, error) {
+	var response VoteResponse
+	err := t.network.deliver(t.from, peer, func(node *Node) {
+		response = node.HandleVote(request)
+	})
+	return response, err
+}
+
+func (t memoryTransport) AppendEntries(peer int, request AppendRequest) (AppendResponse, error) {
+	var response AppendResponse
+	err := t.network.deliver(t.from, peer, func(node *Node) {
+		response = node.HandleAppend(request)
+	})
+	return response, err
+}
+
+func (t memoryTransport) InstallSnapshot(peer int, request SnapshotRequest) (SnapshotResponse, error) {
+	return SnapshotResponse{}, errors.New("snapshots are not supported by the test transport")
+}
+
+type memoryStorage struct {
+	mutex    sync.Mutex
+	term     int64
+	votedFor int
+	commit   int64
+}
+
+func (s *memoryStorage) LoadState(shard string) (int64, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.term, s.votedFor, nil
+}
+
+func (s *memoryStorage) SaveState(shard string, term int64, votedFor int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.term = term
+	s.votedFor = votedFor
+	return nil
+}
+
+func (s *memoryStorage) LoadCommit(shard string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.commit, nil
+}
+
+func (s *memoryStorage) SaveCommit(shard string, lsn int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.commit = lsn
+	return nil
+}
+
+// newNode creates a node of shard sh1 whose log holds a record in each of
+// terms, without starting it.
+func newNode(t *testing.T, id int, network *memoryNetwork, terms []int64) *Node {
+	t.Helper()
+
+	manager, err := wal.NewManager(t.TempDir(), wal.Config{SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(func() {
+		if network != nil {
+			network.isolate(id)
+		}
+		manager.Close()
+	})
+	shardLog, err := manager.Log("sh1")
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	for _, term := range terms {
+		if _, err := shardLog.Append(term, "write", "", nil); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	node, err := New(Config{
+		ID:        id,
+		Shard:     "sh1",
+		Log:       shardLog,
+		Storage:   &memoryStorage{votedFor: NONE},
+		Transport: memoryTransport{network: network, from: id},
+		Members: func() ([]int, error) {
+			ids := []int{}
+			for id := range network.nodes {
+				ids = append(ids, id)
+			}
+			return ids, nil
+		},
+		Apply:                  func(wal.Record) error { return nil },
+		OnLeader:               func(int64) {},
+		HeartbeatInterval:      5 * time.Millisecond,
+		ElectionTimeout:        50 * time.Millisecond,
+		MembersRefreshInterval: time.Hour,
+		LeaderReportInterval:   time.Hour,
+		MaxEntries:             16,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return node
+}
+
+// newCluster starts a node for each of ids on a network of its own.
+func newCluster(t *testing.T, ids ...int) (*memoryNetwork, map[int]*Node) {
+	t.Helper()
+
+	network := &memoryNetwork{nodes: make(map[int]*Node), isolated: make(map[int]bool)}
+	for _, id := range ids {
+		network.nodes[id] = newNode(t, id, network, nil)
+	}
+	for _, node := range network.nodes {
+		node.Start()
+	}
+	return network, network.nodes
+}
+
+// leaderOf returns the node leading the latest term, or NONE.
+func leaderOf(nodes map[int]*Node) int {
+	leader, term := NONE, int64(0)
+	for id, node := range nodes {
+		if status := node.Status(); status.Role == ROLE_LEADER && status.Term > term {
+			leader, term = id, status.Term
+		}
+	}
+	return leader
+}
+
+func termsOf(shardLog *wal.Log) []int64 {
+	terms := []int64{}
+	for lsn := int64(1); lsn <= shardLog.LastLSN(); lsn++ {
+		term, _ := shardLog.TermAt(lsn)
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// entries returns records of the given terms from LSN from on.
+func entries(from int64, terms ...int64) []wal.Record {
+	records := make([]wal.Record, len(terms))
+	for i, term := range terms {
+		records[i] = wal.Record{
+			LSN:       from + int64(i),
+			Term:      term,
+			Timestamp: time.Now(),
+			Op:        "write",
+			Shard:     "sh1",
+		}
+	}
+	return records
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"errors"
+	"time"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
+)
+
+// startPeer starts replicating to peer from next on. The caller holds the
+// mutex and is the leader.
+func (n *Node) startPeer(peer int, next int64) {
+	trigger := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	n.nextLSN[peer] = next
+	n.progress[peer] = &Progress{}
+	n.triggers[peer] = trigger
+	n.peerStops[peer] = stop
+
+	go n.replicateTo(peer, n.term, trigger, stop)
+}
+
+// replicateTo sends the records peer is missing whenever new records are
+// proposed, and a heartbeat at least every HeartbeatInterval, until the node
+// stops leading term or peer leaves the shard.
+func (n *Node) replicateTo(peer int, term int64, trigger <-chan struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if n.sendAppend(peer, term) {
+			select {
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAppend sends peer the records after the last one it is known to have,
+// or has it load a snapshot if the leader no longer retains them. It reports
+// whether peer is still behind and should be sent more right away.
+func (n *Node) sendAppend(peer int, term int64) bool {
+	n.mutex.Lock()
+	if n.role != ROLE_LEADER || n.term != term {
+		n.mutex.Unlock()
+		return false
+	}
+	next := n.nextLSN[peer]
+	commit := n.commitLSN
+	n.mutex.Unlock()
+
+	prevLSN := next - 1
+	prevTerm, ok := n.config.Log.TermAt(prevLSN)
+	if !ok {
+		return n.sendSnapshot(peer, term)
+	}
+	entries, err := n.readEntries(next)
+	if errors.Is(err, wal.ErrNotRetained) {
+		return n.sendSnapshot(peer, term)
+	}
+	if err != nil {
+		n.recordError(peer, err)
+		return false
+	}
+
+	response, err := n.config.Transport.AppendEntries(peer, AppendRequest{
+		Shard:     n.config.Shard,
+		Term:      term,
+		Leader:    n.config.ID,
+		PrevLSN:   prevLSN,
+		PrevTerm:  prevTerm,
+		Entries:   entries,
+		CommitLSN: commit,
+	})
+	if err != nil {
+		n.recordError(peer, err)
+		return false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return false
+	}
+	progress, ok := n.progress[peer]
+	if n.role != ROLE_LEADER || n.term != term || !ok {
+		return false
+	}
+
+	if !response.Success {
+		n.nextLSN[peer] = max(min(next-1, response.LastLSN+1), 1)
+		progress.LastError = ""
+		return true
+	}
+
+	match := prevLSN + int64(len(entries))
+	n.acknowledge(peer, progress, match)
+	return match < n.config.Log.LastLSN()
+}
+
+// readEntries reads up to MaxEntries records from the log starting at from.
+func (n *Node) readEntries(from int64) ([]wal.Record, error) {
+	errFull := errors.New("batch full")
+	entries := []wal.Record{}
+	err := n.config.Log.ReadFrom(from, func(record wal.Record) error {
+		entries = append(entries, record)
+		if len(entries) >= n.config.MaxEntries {
+			return errFull
+		}
+		return nil
+	})
+	if errors.Is(err, errFull) {
+		err = nil
+	}
+	return entries, err
+}
+
+// sendSnapshot has peer load a snapshot of the shard from the leader, and
+// continues replicating after the LSN it reflects.
+func (n *Node) sendSnapshot(peer int, term int64) bool {
+	response, err := n.config.Transport.InstallSnapshot(peer, SnapshotRequest{
+		Shard:  n.config.Shard,
+		Term:   term,
+		Leader: n.config.ID,
+	})
+	if err != nil {
+		n.recordError(peer, err)
+		return false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return false
+	}
+	progress, ok := n.progress[peer]
+	if n.role != ROLE_LEADER || n.term != term || !ok {
+		return false
+	}
+
+	n.acknowledge(peer, progress, response.LastLSN)
+	return true
+}
+
+// acknowledge records that peer has every record up to match. The caller
+// holds the mutex.
+func (n *Node) acknowledge(peer int, progress *Progress, match int64) {
+	if match > progress.MatchLSN {
+		progress.MatchLSN = match
+	}
+	progress.LastAck = time.Now()
+	progress.LastError = ""
+	n.nextLSN[peer] = match + 1
+
+	n.advanceCommit()
+	n.broadcast()
+}
+
+func (n *Node) recordError(peer int, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if progress, ok := n.progress[peer]; ok {
+		progress.LastError = err.Error()
+	}
+}
@@ -0,0 +1,65 @@
+package raft
+
+import "github.com/yatharthsameer/galaxydb/server/internal/wal"
+
+type VoteRequest struct {
+	Shard     string `json:"shard"`
+	Term      int64  `json:"term"`
+	Candidate int    `json:"candidate"`
+	LastLSN   int64  `json:"last_lsn"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type VoteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+// AppendRequest carries the records after PrevLSN, or none for a heartbeat.
+type AppendRequest struct {
+	Shard     string       `json:"shard"`
+	Term      int64        `json:"term"`
+	Leader    int          `json:"leader"`
+	PrevLSN   int64        `json:"prev_lsn"`
+	PrevTerm  int64        `json:"prev_term"`
+	Entries   []wal.Record `json:"entries"`
+	CommitLSN int64        `json:"commit_lsn"`
+}
+
+// AppendResponse reports the last LSN the follower now shares with the
+// leader on success, and the LSN the leader should retry after otherwise.
+type AppendResponse struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"`
+	LastLSN int64 `json:"last_lsn"`
+}
+
+// SnapshotRequest asks a follower that is behind the leader's retained log to
+// load a snapshot of the shard from the leader.
+type SnapshotRequest struct {
+	Shard  string `json:"shard"`
+	Term   int64  `json:"term"`
+	Leader int    `json:"leader"`
+}
+
+type SnapshotResponse struct {
+	Term    int64 `json:"term"`
+	LastLSN int64 `json:"last_lsn"`
+}
+
+// Transport delivers the RPCs of a node to the other replicas of its shard.
+type Transport interface {
+	RequestVote(peer int, request VoteRequest) (VoteResponse, error)
+	AppendEntries(peer int, request AppendRequest) (AppendResponse, error)
+	InstallSnapshot(peer int, request SnapshotRequest) (SnapshotResponse, error)
+}
+
+// Storage persists the term and vote of a node, which must survive restarts
+// for elections to be safe, and its commit LSN, so that a restarted node can
+// apply the records it knew to be committed before hearing from a leader.
+type Storage interface {
+	LoadState(shard string) (term int64, votedFor int, err error)
+	SaveState(shard string, term int64, votedFor int) error
+	LoadCommit(shard string) (int64, error)
+	SaveCommit(shard string, lsn int64) error
+}
@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ARCHIVE_RETRY_INTERVAL is how often segments that failed to be archived are
+// retried, even if no new segment was finished since.
+const ARCHIVE_RETRY_INTERVAL = 10 * time.Second
+
+// Archiver stores finished WAL segments outside of the server, so that they
+// survive the server's container. Archiving the same segment twice must be
+// harmless, since segments are archived again after a restart.
+type Archiver interface {
+	// Archive durably stores the file at path as name under shard. name may
+	// include a subdirectory.
+	Archive(shard string, name string, path string) error
+}
+
+// DirArchiver archives segments into a directory, such as a mounted volume.
+type DirArchiver struct {
+	dir string
+}
+
+func NewDirArchiver(dir string) *DirArchiver {
+	return &DirArchiver{dir: dir}
+}
+
+func (a *DirArchiver) Archive(shard string, name string, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(a.dir, shard, name)
+	if archived, err := os.Stat(dst); err == nil && archived.Size() == info.Size() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("error creating archive directory: %w", err)
+	}
+
+	tmp := dst + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating archive file: %w", err)
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing archive file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing archive file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing archive file: %w", err)
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// HTTPArchiver archives segments by PUTting them to <url>/<shard>/<name>.
+// This is enough for an S3-compatible store such as a local MinIO bucket
+// that accepts anonymous uploads.
+type HTTPArchiver struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPArchiver(url string) *HTTPArchiver {
+	return &HTTPArchiver{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (a *HTTPArchiver) Archive(shard string, name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, a.url+"/"+shard+"/"+name, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading to archive: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error uploading to archive: %s", resp.Status)
+	}
+	return nil
+}
+
+// archive ships the finished segments of every log to the archiver whenever
+// a segment is finished, and periodically retries the ones that failed.
+func (m *Manager) archive() {
+	defer close(m.archiveStopped)
+
+	ticker := time.NewTicker(ARCHIVE_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.archiveStop:
+			return
+		case <-m.archiveSignal:
+		case <-ticker.C:
+		}
+
+		m.mutex.Lock()
+		logs := make([]*Log, 0, len(m.logs))
+		for _, l := range m.logs {
+			logs = append(logs, l)
+		}
+		m.mutex.Unlock()
+
+		for _, l := range logs {
+			if err := l.archiveFinished(m.config.Archiver); err != nil {
+				log.Printf("Error archiving WAL of shard %s: %v\n", l.shard, err)
+			}
+		}
+	}
+}
+
+// signalArchive wakes up the archiver without waiting for it.
+func (m *Manager) signalArchive() {
+	select {
+	case m.archiveSignal <- struct{}{}:
+	default:
+	}
+}
+
+// archiveFinished archives every segment of the log except the current one
+// that has not been archived yet. Appends are not blocked while it copies.
+func (l *Log) archiveFinished(archiver Archiver) error {
+	l.mutex.Lock()
+	pending := []segment{}
+	for _, seg := range l.segments[:max(len(l.segments)-1, 0)] {
+		if !seg.archived {
+			pending = append(pending, seg)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, seg := range pending {
+		// A segment that is gone was removed by Reset and needs no archiving.
+		if _, err := os.Stat(seg.path); !errors.Is(err, fs.ErrNotExist) {
+			if err := archiver.Archive(l.shard, filepath.Base(seg.path), seg.path); err != nil {
+				return err
+			}
+		}
+
+		l.mutex.Lock()
+		for i := range l.segments {
+			if l.segments[i].path == seg.path {
+				l.segments[i].archived = true
+			}
+		}
+		l.mutex.Unlock()
+	}
+	return nil
+}
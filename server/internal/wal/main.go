@@ -0,0 +1,1051 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SEGMENT_EXTENSION = ".wal"
+	OP_CHECKPOINT     = "checkpoint"
+)
+
+var (
+	ErrNotRetained = errors.New("WAL position is no longer retained")
+	ErrLSNGap      = errors.New("WAL record does not follow the last LSN")
+)
+
+// segment is one file of a shard's log. It is named after the first LSN that
+// could be appended to it, so sorting segments by name sorts them by LSN.
+// version is the format the segment was written in, or 0 if it is empty.
+type segment struct {
+	firstLSN int64
+	path     string
+	size     int64
+	version  uint32
+	archived bool
+}
+
+// termStart records that the records from lsn onwards were written in term,
+// up to the next termStart.
+type termStart struct {
+	lsn  int64
+	term int64
+}
+
+// Log is the write-ahead log of a single shard. Every shard has its own
+// directory of segments under the manager's directory, so positions and
+// retention of one shard never depend on another.
+//
+// lastLSN is the last record known to be on disk, while assignedLSN also
+// counts records written to the current segment but not yet synced.
+type Log struct {
+	mutex         sync.Mutex
+	shard         string
+	dir           string
+	segmentSize   int64
+	writer        *groupWriter
+	segments      []segment
+	file          *os.File
+	syncedSize    int64
+	lastLSN       int64
+	assignedLSN   int64
+	checkpointLSN int64
+
+	// terms indexes the term of every retained record.
+	terms []termStart
+
+	// archiving is set when the manager archives finished segments, which
+	// are then only truncated once archived. onFinish is called whenever a
+	// segment is finished.
+	archiving bool
+	onFinish  func()
+
+	// changed is closed and replaced whenever lastLSN advances.
+	changed chan struct{}
+}
+
+type Config struct {
+	// SegmentSize is the size in bytes past which a segment is rotated.
+	SegmentSize int64
+	// GroupCommitWindow is how long the writer waits for more appends to
+	// share an fsync with the first one. With no window, only appends that
+	// are already queued are batched.
+	GroupCommitWindow time.Duration
+	// GroupCommitMaxBatch caps the number of appends per fsync.
+	GroupCommitMaxBatch int
+	// Archiver, if set, receives every finished segment.
+	Archiver Archiver
+}
+
+type Manager struct {
+	mutex  sync.Mutex
+	dir    string
+	config Config
+	writer *groupWriter
+	logs   map[string]*Log
+
+	archiveSignal  chan struct{}
+	archiveStop    chan struct{}
+	archiveStopped chan struct{}
+}
+
+// NewManager opens the WAL of every shard found under dir and starts the
+// writer that appends to them.
+func NewManager(dir string, config Config) (*Manager, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating WAL directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WAL directory: %w", err)
+	}
+
+	m := &Manager{
+		dir:    dir,
+		config: config,
+		writer: newGroupWriter(config.GroupCommitWindow, config.GroupCommitMaxBatch),
+		logs:   make(map[string]*Log),
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		l, err := m.open(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m.logs[entry.Name()] = l
+	}
+
+	go m.writer.run()
+	if config.Archiver != nil {
+		m.archiveSignal = make(chan struct{}, 1)
+		m.archiveStop = make(chan struct{})
+		m.archiveStopped = make(chan struct{})
+		go m.archive()
+		m.signalArchive()
+	}
+	return m, nil
+}
+
+func (m *Manager) open(shard string) (*Log, error) {
+	l, err := openLog(filepath.Join(m.dir, shard), shard, m.config.SegmentSize, m.writer)
+	if err != nil {
+		return nil, err
+	}
+	if m.config.Archiver != nil {
+		l.archiving = true
+		l.onFinish = m.signalArchive
+	}
+	return l, nil
+}
+
+// Close stops the writer and the archiver and closes every log. Appends
+// after Close fail.
+func (m *Manager) Close() error {
+	m.writer.close()
+	if m.archiveStop != nil {
+		close(m.archiveStop)
+		<-m.archiveStopped
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var closeErr error
+	for _, l := range m.logs {
+		if err := l.close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// Log returns the WAL of shard, creating it if the shard has none yet.
+func (m *Manager) Log(shard string) (*Log, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if l, ok := m.logs[shard]; ok {
+		return l, nil
+	}
+
+	l, err := m.open(shard)
+	if err != nil {
+		return nil, err
+	}
+	m.logs[shard] = l
+	return l, nil
+}
+
+// Get returns the WAL of shard if the shard has one.
+func (m *Manager) Get(shard string) (*Log, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	l, ok := m.logs[shard]
+	return l, ok
+}
+
+func (m *Manager) Shards() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shards := make([]string, 0, len(m.logs))
+	for shard := range m.logs {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// Positions returns the last durable LSN of every shard.
+func (m *Manager) Positions() map[string]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	positions := make(map[string]int64, len(m.logs))
+	for shard, l := range m.logs {
+		positions[shard] = l.LastLSN()
+	}
+	return positions
+}
+
+func segmentName(firstLSN int64) string {
+	return fmt.Sprintf("%020d%s", firstLSN, SEGMENT_EXTENSION)
+}
+
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WAL directory: %w", err)
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SEGMENT_EXTENSION) {
+			continue
+		}
+		firstLSN, err := strconv.ParseInt(strings.TrimSuffix(name, SEGMENT_EXTENSION), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("error reading WAL segment %s: %w", name, err)
+		}
+		path := filepath.Join(dir, name)
+		version, err := segmentVersion(path)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{
+			firstLSN: firstLSN,
+			path:     path,
+			size:     info.Size(),
+			version:  version,
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstLSN < segments[j].firstLSN
+	})
+
+	return segments, nil
+}
+
+// segmentVersion returns the format version of the segment at path, or 0 if
+// its header is missing or unreadable, in which case scanning reports it.
+func segmentVersion(path string) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening WAL file: %w", err)
+	}
+	defer file.Close()
+
+	version, err := readSegmentHeader(file)
+	if err != nil {
+		return 0, nil
+	}
+	return version, nil
+}
+
+// SegmentPaths returns the paths of the segment files in dir in LSN order.
+func SegmentPaths(dir string) ([]string, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(segments))
+	for i, seg := range segments {
+		paths[i] = seg.path
+	}
+	return paths, nil
+}
+
+func openLog(dir string, shard string, segmentSize int64, writer *groupWriter) (*Log, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating WAL directory for shard %s: %w", shard, err)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		shard:       shard,
+		dir:         dir,
+		segmentSize: segmentSize,
+		writer:      writer,
+		segments:    segments,
+		changed:     make(chan struct{}),
+	}
+	err = l.scan(func(record Record) error {
+		l.indexTerm(record, l.lastLSN)
+		if record.LSN > l.lastLSN {
+			l.lastLSN = record.LSN
+		}
+		if record.Op == OP_CHECKPOINT && record.LSN > l.checkpointLSN {
+			l.checkpointLSN = record.LSN
+		}
+		return nil
+	})
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) {
+		log.Printf("WAL of shard %s stops at %v\n", shard, corruption)
+		err = l.discardFrom(corruption)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.assignedLSN = l.lastLSN
+	if len(l.segments) != 0 {
+		l.syncedSize = l.segments[len(l.segments)-1].size
+	}
+	if err := l.upgradeCurrent(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// upgradeCurrent makes sure that records are only appended to a segment of
+// the current format. A current segment of an older format is finished, or
+// rewritten if it holds nothing but checkpoints.
+func (l *Log) upgradeCurrent() error {
+	if len(l.segments) == 0 {
+		return nil
+	}
+	current := &l.segments[len(l.segments)-1]
+	if current.version == 0 || current.version == FORMAT_VERSION {
+		return nil
+	}
+
+	if current.firstLSN != l.lastLSN+1 {
+		return l.rotate(l.lastLSN + 1)
+	}
+
+	if err := os.Truncate(current.path, 0); err != nil {
+		return fmt.Errorf("error rewriting WAL segment: %w", err)
+	}
+	current.size = 0
+	current.version = 0
+	l.syncedSize = 0
+	return l.writeCheckpoint()
+}
+
+// indexTerm adds the record to the term index if it starts a new term. last
+// is the last LSN before the record.
+func (l *Log) indexTerm(record Record, last int64) {
+	n := len(l.terms)
+	if n == 0 || (record.LSN > last && record.Term != l.terms[n-1].term) {
+		l.terms = append(l.terms, termStart{lsn: record.LSN, term: record.Term})
+	}
+}
+
+// trimTerms drops the index entries of records after lsn.
+func (l *Log) trimTerms(lsn int64) {
+	for len(l.terms) != 0 && l.terms[len(l.terms)-1].lsn > lsn {
+		l.terms = l.terms[:len(l.terms)-1]
+	}
+}
+
+func (l *Log) termAt(lsn int64) (int64, bool) {
+	if lsn == 0 {
+		return 0, true
+	}
+	if lsn > l.lastLSN {
+		return 0, false
+	}
+	i := sort.Search(len(l.terms), func(i int) bool {
+		return l.terms[i].lsn > lsn
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return l.terms[i].term, true
+}
+
+// TermAt returns the term of the durable record at lsn. It reports false if
+// the record is past the end of the log or no longer retained, except for
+// the last checkpointed record, whose term is kept with the checkpoint.
+func (l *Log) TermAt(lsn int64) (int64, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.termAt(lsn)
+}
+
+// Last returns the LSN and term of the last durable record.
+func (l *Log) Last() (int64, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	term, _ := l.termAt(l.lastLSN)
+	return l.lastLSN, term
+}
+
+// discardFrom truncates the log at a corrupt or torn record so that appends
+// continue from the last good one. Segments after it are renamed rather
+// than deleted, so they can still be inspected.
+func (l *Log) discardFrom(corruption *CorruptionError) error {
+	for i := range l.segments {
+		if l.segments[i].path != corruption.Path {
+			continue
+		}
+
+		offset := corruption.Offset
+		if offset < HEADER_SIZE {
+			offset = 0
+		}
+		if err := os.Truncate(l.segments[i].path, offset); err != nil {
+			return fmt.Errorf("error truncating WAL file: %w", err)
+		}
+		l.segments[i].size = offset
+
+		for _, seg := range l.segments[i+1:] {
+			log.Printf("Setting aside WAL segment %s written after the corrupt record\n", seg.path)
+			if err := os.Rename(seg.path, seg.path+".corrupt"); err != nil {
+				return fmt.Errorf("error setting aside WAL segment: %w", err)
+			}
+		}
+		l.segments = l.segments[:i+1]
+		return nil
+	}
+	return corruption
+}
+
+func (l *Log) Shard() string {
+	return l.shard
+}
+
+func (l *Log) LastLSN() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lastLSN
+}
+
+// CheckpointLSN returns the LSN up to which the shard's state is known to be
+// durable outside of the WAL.
+func (l *Log) CheckpointLSN() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.checkpointLSN
+}
+
+// Append durably writes a record for op in term, carrying the idempotency
+// key of the request it logs if any, and returns it with its LSN. The record
+// is handed to the manager's writer, which may sync it together with appends
+// to this and other logs.
+func (l *Log) Append(term int64, op string, key string, payload []byte) (Record, error) {
+	request := &appendRequest{
+		log:     l,
+		term:    term,
+		op:      op,
+		key:     key,
+		payload: payload,
+		done:    make(chan struct{}),
+	}
+	if err := l.writer.submit(request); err != nil {
+		return Record{}, err
+	}
+
+	<-request.done
+	return request.record, request.err
+}
+
+// AppendRecord durably writes a record received from another replica, keeping
+// its LSN and timestamp. Records the log already has are skipped, and records
+// that would leave a gap fail with ErrLSNGap.
+func (l *Log) AppendRecord(record Record) error {
+	request := &appendRequest{
+		log:        l,
+		replicated: true,
+		record:     record,
+		done:       make(chan struct{}),
+	}
+	if err := l.writer.submit(request); err != nil {
+		return err
+	}
+
+	<-request.done
+	return request.err
+}
+
+// AppendRecords durably writes records received from another replica in
+// order, like AppendRecord, letting the writer sync them together.
+func (l *Log) AppendRecords(records []Record) error {
+	requests := make([]*appendRequest, len(records))
+	for i, record := range records {
+		requests[i] = &appendRequest{
+			log:        l,
+			replicated: true,
+			record:     record,
+			done:       make(chan struct{}),
+		}
+		if err := l.writer.submit(requests[i]); err != nil {
+			for _, request := range requests[:i] {
+				<-request.done
+			}
+			return err
+		}
+	}
+
+	var err error
+	for _, request := range requests {
+		<-request.done
+		if request.err != nil && err == nil {
+			err = request.err
+		}
+	}
+	return err
+}
+
+// commit writes a batch of appends and syncs them with a single fsync. An
+// append of a record that is too large fails on its own. If any other fails
+// to be written, the whole batch is rolled back and fails with it.
+func (l *Log) commit(requests []*appendRequest) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for _, request := range requests {
+		if request.replicated {
+			if request.record.LSN <= l.assignedLSN {
+				continue
+			}
+			if request.record.LSN != l.assignedLSN+1 {
+				request.err = fmt.Errorf("%w: got %d after %d", ErrLSNGap, request.record.LSN, l.assignedLSN)
+				continue
+			}
+			request.record.Shard = l.shard
+		} else {
+			request.record = Record{
+				LSN:       l.assignedLSN + 1,
+				Term:      request.term,
+				Timestamp: now,
+				Op:        request.op,
+				Shard:     l.shard,
+				Key:       request.key,
+				Payload:   request.payload,
+			}
+		}
+		err := l.write(request.record)
+		if errors.Is(err, ErrRecordTooLarge) {
+			request.err = err
+			continue
+		}
+		if err != nil {
+			l.rollback()
+			return err
+		}
+	}
+
+	if err := l.sync(); err != nil {
+		l.rollback()
+		return err
+	}
+	return nil
+}
+
+// Checkpoint records that every record up to lsn has been made durable
+// elsewhere. When the checkpoint covers the whole log, the current segment is
+// rotated first so that Truncate can delete it.
+func (l *Log) Checkpoint(lsn int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if lsn <= l.checkpointLSN {
+		return nil
+	}
+	if lsn > l.lastLSN {
+		return fmt.Errorf("checkpoint LSN %d is ahead of the WAL of shard %s at %d", lsn, l.shard, l.lastLSN)
+	}
+
+	if lsn == l.assignedLSN && len(l.segments) != 0 && l.segments[len(l.segments)-1].firstLSN != lsn+1 {
+		if err := l.rotate(lsn + 1); err != nil {
+			return err
+		}
+	}
+
+	previous := l.checkpointLSN
+	l.checkpointLSN = lsn
+	if err := l.writeCheckpoint(); err != nil {
+		l.checkpointLSN = previous
+		return err
+	}
+	return nil
+}
+
+// writeCheckpoint durably writes a checkpoint record for checkpointLSN,
+// carrying the term of the record it covers.
+func (l *Log) writeCheckpoint() error {
+	if l.checkpointLSN == 0 {
+		return nil
+	}
+
+	term, _ := l.termAt(l.checkpointLSN)
+	record := Record{
+		LSN:       l.checkpointLSN,
+		Term:      term,
+		Timestamp: time.Now(),
+		Op:        OP_CHECKPOINT,
+		Shard:     l.shard,
+	}
+	if err := l.write(record); err != nil {
+		l.rollback()
+		return err
+	}
+	if err := l.sync(); err != nil {
+		l.rollback()
+		return err
+	}
+	return nil
+}
+
+// Truncate deletes the segments that only hold records up to lsn. Records
+// after the last checkpoint, and segments not archived yet, are always kept.
+func (l *Log) Truncate(lsn int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if lsn > l.checkpointLSN {
+		lsn = l.checkpointLSN
+	}
+
+	for len(l.segments) > 1 && l.segments[1].firstLSN <= lsn+1 {
+		if l.archiving && !l.segments[0].archived {
+			break
+		}
+		err := os.Remove(l.segments[0].path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing WAL segment: %w", err)
+		}
+		l.segments = l.segments[1:]
+	}
+
+	return nil
+}
+
+// TruncateAfter discards every record after lsn. It is used to drop records
+// that conflict with the log of a new leader, which are never checkpointed.
+func (l *Log) TruncateAfter(lsn int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if lsn >= l.assignedLSN {
+		return nil
+	}
+	if lsn < l.checkpointLSN {
+		return fmt.Errorf("cannot truncate the WAL of shard %s at %d before its checkpoint at %d", l.shard, lsn, l.checkpointLSN)
+	}
+
+	if err := l.sync(); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	for len(l.segments) != 0 && l.segments[len(l.segments)-1].firstLSN > lsn {
+		if err := os.Remove(l.segments[len(l.segments)-1].path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing WAL segment: %w", err)
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+
+	if current := len(l.segments) - 1; current >= 0 {
+		errCut := errors.New("cut")
+		cut := l.segments[current].size
+		offset := int64(HEADER_SIZE)
+		err := scanSegment(l.segments[current].path, func(record Record, end int64) error {
+			if record.Op != OP_CHECKPOINT && record.LSN > lsn {
+				cut = offset
+				return errCut
+			}
+			offset = end
+			return nil
+		})
+		if err != nil && !errors.Is(err, errCut) {
+			return err
+		}
+		if err := os.Truncate(l.segments[current].path, cut); err != nil {
+			return fmt.Errorf("error truncating WAL file: %w", err)
+		}
+		l.segments[current].size = cut
+	}
+
+	l.syncedSize = 0
+	if len(l.segments) != 0 {
+		l.syncedSize = l.segments[len(l.segments)-1].size
+	}
+	l.lastLSN = lsn
+	l.assignedLSN = lsn
+	l.trimTerms(lsn)
+
+	if err := l.upgradeCurrent(); err != nil {
+		return err
+	}
+	// Checkpoints written after the discarded records went with them.
+	return l.writeCheckpoint()
+}
+
+// Reset discards the whole log and restarts it after lsn, which was written
+// in term. It is used when the shard's state has been loaded from a snapshot
+// taken at lsn, which makes every older record redundant.
+func (l *Log) Reset(lsn int64, term int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	for _, seg := range l.segments {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing WAL segment: %w", err)
+		}
+	}
+
+	l.segments = nil
+	l.syncedSize = 0
+	l.lastLSN = lsn
+	l.assignedLSN = lsn
+	l.checkpointLSN = lsn
+	l.terms = []termStart{{lsn: lsn, term: term}}
+
+	if err := l.writeCheckpoint(); err != nil {
+		return err
+	}
+	l.notify()
+	return nil
+}
+
+// write appends record to the current segment without syncing it, rotating
+// to a new segment first if the current one is full. A record that is too
+// large fails with ErrRecordTooLarge before anything is written.
+func (l *Log) write(record Record) error {
+	recordData, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	l.indexTerm(record, l.assignedLSN)
+
+	current := len(l.segments) - 1
+	if current < 0 || (l.segments[current].size > 0 && l.segments[current].size+int64(len(recordData)) > l.segmentSize &&
+		l.segments[current].firstLSN != l.assignedLSN+1) {
+		if err := l.rotate(l.assignedLSN + 1); err != nil {
+			return err
+		}
+		current = len(l.segments) - 1
+	}
+	if l.segments[current].size == 0 {
+		recordData = append(segmentHeader(), recordData...)
+		l.segments[current].version = FORMAT_VERSION
+	}
+
+	if l.file == nil {
+		walFile, err := os.OpenFile(l.segments[current].path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening WAL file: %w", err)
+		}
+		l.file = walFile
+	}
+
+	_, err = l.file.Write(recordData)
+	if err != nil {
+		return fmt.Errorf("error writing to WAL file: %w", err)
+	}
+
+	l.segments[current].size += int64(len(recordData))
+	if record.LSN > l.assignedLSN {
+		l.assignedLSN = record.LSN
+	}
+	return nil
+}
+
+// rotate syncs and closes the current segment and starts a new one.
+func (l *Log) rotate(firstLSN int64) error {
+	if err := l.sync(); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	l.segments = append(l.segments, segment{
+		firstLSN: firstLSN,
+		path:     filepath.Join(l.dir, segmentName(firstLSN)),
+	})
+	l.syncedSize = 0
+	if l.onFinish != nil {
+		l.onFinish()
+	}
+	return nil
+}
+
+func (l *Log) sync() error {
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("error flushing WAL file: %w", err)
+		}
+	}
+
+	if len(l.segments) != 0 {
+		l.syncedSize = l.segments[len(l.segments)-1].size
+	}
+	if l.assignedLSN != l.lastLSN {
+		l.lastLSN = l.assignedLSN
+		l.notify()
+	}
+	return nil
+}
+
+func (l *Log) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed once the log has durable records
+// after lsn, or has been reset.
+func (l *Log) Changed(lsn int64) <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lastLSN > lsn {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return l.changed
+}
+
+// rollback drops everything written to the current segment since the last
+// sync, so that the next append does not follow a partial record.
+func (l *Log) rollback() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	if current := len(l.segments) - 1; current >= 0 {
+		if err := os.Truncate(l.segments[current].path, l.syncedSize); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error rolling back WAL segment %s: %v\n", l.segments[current].path, err)
+		}
+		l.segments[current].size = l.syncedSize
+	}
+	l.assignedLSN = l.lastLSN
+	l.trimTerms(l.lastLSN)
+}
+
+func (l *Log) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.sync()
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Replay calls fn for every operation record in the log, in LSN order.
+func (l *Log) Replay(fn func(Record) error) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.scan(func(record Record) error {
+		if record.Op == OP_CHECKPOINT {
+			return nil
+		}
+		return fn(record)
+	})
+}
+
+// FirstLSN returns the oldest LSN that can still be read from the log.
+func (l *Log) FirstLSN() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.segments) == 0 {
+		return l.lastLSN + 1
+	}
+	return l.segments[0].firstLSN
+}
+
+// ReadFrom calls fn for every operation record from LSN from up to the last
+// durable LSN at the time of the call. Appends are not blocked while it
+// reads, so fn may be slow. It fails with ErrNotRetained if records from
+// from onwards have already been truncated.
+func (l *Log) ReadFrom(from int64, fn func(Record) error) error {
+	l.mutex.Lock()
+	segments := append([]segment(nil), l.segments...)
+	last := l.lastLSN
+	l.mutex.Unlock()
+
+	if from > last {
+		return nil
+	}
+	if len(segments) == 0 || from < segments[0].firstLSN {
+		return fmt.Errorf("%w: shard %s starts at LSN %d", ErrNotRetained, l.shard, l.FirstLSN())
+	}
+
+	errDone := errors.New("done")
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].firstLSN <= from {
+			continue
+		}
+
+		_, statErr := os.Stat(seg.path)
+		if os.IsNotExist(statErr) {
+			return fmt.Errorf("%w: segment %s was truncated", ErrNotRetained, seg.path)
+		}
+
+		err := ScanSegment(seg.path, func(record Record) error {
+			if record.LSN > last {
+				return errDone
+			}
+			if record.Op == OP_CHECKPOINT || record.LSN < from {
+				return nil
+			}
+			return fn(record)
+		})
+		if errors.Is(err, errDone) {
+			return nil
+		}
+		// The current segment may end in a record that is still being
+		// written. Everything up to last was read by then.
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) && i == len(segments)-1 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportJSON writes every record of the log to w as one JSON object per
+// line, for debugging.
+func (l *Log) ExportJSON(w io.Writer) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	encoder := json.NewEncoder(w)
+	return l.scan(func(record Record) error {
+		return encoder.Encode(record)
+	})
+}
+
+// scan reads every record of every segment, stopping with a
+// *CorruptionError at the first record that is torn or fails its checksum.
+func (l *Log) scan(fn func(Record) error) error {
+	for _, seg := range l.segments {
+		if err := ScanSegment(seg.path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanSegment calls fn for every record in the segment file at path.
+func ScanSegment(path string, fn func(Record) error) error {
+	return scanSegment(path, func(record Record, _ int64) error {
+		return fn(record)
+	})
+}
+
+// scanSegment is ScanSegment that also passes fn the offset at which each
+// record ends.
+func scanSegment(path string, fn func(Record, int64) error) error {
+	walFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening WAL file: %w", err)
+	}
+	defer walFile.Close()
+
+	reader := bufio.NewReader(walFile)
+	version, err := readSegmentHeader(reader)
+	if errors.Is(err, ErrTruncatedRecord) {
+		info, statErr := walFile.Stat()
+		if statErr == nil && info.Size() == 0 {
+			return nil
+		}
+	}
+	if isCorruption(err) {
+		return &CorruptionError{Path: path, Offset: 0, Err: err}
+	}
+	if err != nil {
+		return fmt.Errorf("error reading WAL segment %s: %w", path, err)
+	}
+
+	offset := int64(HEADER_SIZE)
+	for {
+		record, size, err := readRecord(reader, version)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if isCorruption(err) {
+			return &CorruptionError{Path: path, Offset: offset, Err: err}
+		}
+		if err != nil {
+			return fmt.Errorf("error reading WAL segment %s: %w", path, err)
+		}
+		offset += int64(size)
+
+		if err := fn(record, offset); err != nil {
+			return err
+		}
+	}
+}
+
+func isCorruption(err error) bool {
+	return errors.Is(err, ErrTruncatedRecord) || errors.Is(err, ErrCorruptRecord)
+}
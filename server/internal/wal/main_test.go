@@ -0,0 +1,254 @@
+package wal
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogDiscardsDamagedTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// segmentSize is small enough to give every record its own segment
+		// when it is set.
+		segmentSize int64
+		// damage changes the segments of a log holding LSNs 1 to 3.
+		damage func(t *testing.T, paths []string)
+		// wantLast is the last LSN left after reopening the log.
+		wantLast int64
+		// wantCorrupt is how many segments are set aside.
+		wantCorrupt int
+	}{
+		{
+			name: "torn frame",
+			damage: func(t *testing.T, paths []string) {
+				appendBytes(t, paths[len(paths)-1], frameOf(t, 4)[:FRAME_HEADER_SIZE+5])
+			},
+			wantLast: 3,
+		},
+		{
+			name: "frame failing its checksum",
+			damage: func(t *testing.T, paths []string) {
+				frame := frameOf(t, 4)
+				frame[len(frame)-1] ^= 0xff
+				appendBytes(t, paths[len(paths)-1], frame)
+			},
+			wantLast: 3,
+		},
+		{
+			name: "last record cut short",
+			damage: func(t *testing.T, paths []string) {
+				truncateBy(t, paths[len(paths)-1], 1)
+			},
+			wantLast: 2,
+		},
+		{
+			name:        "corrupt record before later segments",
+			segmentSize: 1,
+			damage: func(t *testing.T, paths []string) {
+				truncateBy(t, paths[1], 1)
+			},
+			wantLast:    1,
+			wantCorrupt: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := Config{SegmentSize: 1 << 20}
+			if test.segmentSize != 0 {
+				config.SegmentSize = test.segmentSize
+			}
+
+			manager, shardLog := openManager(t, dir, config)
+			for i := 0; i < 3; i++ {
+				if _, err := shardLog.Append(1, "write", "", []byte(`{"data":[]}`)); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			manager.Close()
+
+			paths, err := SegmentPaths(filepath.Join(dir, "sh1"))
+			if err != nil {
+				t.Fatalf("SegmentPaths: %v", err)
+			}
+			test.damage(t, paths)
+
+			manager, shardLog = openManager(t, dir, config)
+			if last := shardLog.LastLSN(); last != test.wantLast {
+				t.Errorf("LastLSN is %d after reopening, want %d", last, test.wantLast)
+			}
+			if lsns := replayLSNs(t, shardLog); len(lsns) != int(test.wantLast) {
+				t.Errorf("replayed LSNs %v, want 1 to %d", lsns, test.wantLast)
+			}
+			corrupt, _ := filepath.Glob(filepath.Join(dir, "sh1", "*.corrupt"))
+			if len(corrupt) != test.wantCorrupt {
+				t.Errorf("set aside %d segments, want %d", len(corrupt), test.wantCorrupt)
+			}
+
+			record, err := shardLog.Append(1, "write", "", []byte(`{"data":[]}`))
+			if err != nil {
+				t.Fatalf("Append after reopening: %v", err)
+			}
+			if record.LSN != test.wantLast+1 {
+				t.Errorf("appended LSN %d after reopening, want %d", record.LSN, test.wantLast+1)
+			}
+			manager.Close()
+
+			manager, shardLog = openManager(t, dir, config)
+			defer manager.Close()
+			if lsns := replayLSNs(t, shardLog); len(lsns) != int(test.wantLast)+1 {
+				t.Errorf("replayed LSNs %v after the second reopen, want 1 to %d", lsns, test.wantLast+1)
+			}
+		})
+	}
+}
+
+func TestAppendRejectsOversizedFields(t *testing.T) {
+	tooLong := strings.Repeat("x", math.MaxUint16+1)
+
+	tests := []struct {
+		name    string
+		op      string
+		key     string
+		payload []byte
+	}{
+		{name: "op", op: tooLong},
+		{name: "key", op: "write", key: tooLong},
+		{name: "payload", op: "write", payload: make([]byte, MAX_RECORD_SIZE)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manager, shardLog := openManager(t, dir, Config{SegmentSize: 1 << 20})
+			defer manager.Close()
+
+			if _, err := shardLog.Append(1, test.op, test.key, test.payload); !errors.Is(err, ErrRecordTooLarge) {
+				t.Fatalf("Append returned error %v, want ErrRecordTooLarge", err)
+			}
+
+			record, err := shardLog.Append(1, "write", "request-1", []byte(`{"data":[]}`))
+			if err != nil {
+				t.Fatalf("Append after the rejected record: %v", err)
+			}
+			if record.LSN != 1 {
+				t.Errorf("appended LSN %d after the rejected record, want 1", record.LSN)
+			}
+			if lsns := replayLSNs(t, shardLog); len(lsns) != 1 {
+				t.Errorf("replayed LSNs %v, want only 1", lsns)
+			}
+		})
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{SegmentSize: 1 << 20}
+	manager, shardLog := openManager(t, dir, config)
+
+	for _, term := range []int64{1, 1, 2, 2, 2} {
+		if _, err := shardLog.Append(term, "write", "", nil); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := shardLog.TruncateAfter(3); err != nil {
+		t.Fatalf("TruncateAfter: %v", err)
+	}
+	if _, ok := shardLog.TermAt(4); ok {
+		t.Errorf("TermAt(4) is still known after truncating at 3")
+	}
+	record, err := shardLog.Append(3, "write", "", nil)
+	if err != nil {
+		t.Fatalf("Append after truncating: %v", err)
+	}
+	if record.LSN != 4 {
+		t.Errorf("appended LSN %d after truncating at 3, want 4", record.LSN)
+	}
+	manager.Close()
+
+	manager, shardLog = openManager(t, dir, config)
+	defer manager.Close()
+	if lsn, term := shardLog.Last(); lsn != 4 || term != 3 {
+		t.Errorf("Last is LSN %d in term %d after reopening, want LSN 4 in term 3", lsn, term)
+	}
+	for lsn, want := range map[int64]int64{1: 1, 3: 2, 4: 3} {
+		if term, ok := shardLog.TermAt(lsn); !ok || term != want {
+			t.Errorf("TermAt(%d) is %d, %v, want %d", lsn, term, ok, want)
+		}
+	}
+}
+
+func openManager(t *testing.T, dir string, config Config) (*Manager, *Log) {
+	t.Helper()
+
+	manager, err := NewManager(dir, config)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+
+	shardLog, err := manager.Log("sh1")
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	return manager, shardLog
+}
+
+func replayLSNs(t *testing.T, shardLog *Log) []int64 {
+	t.Helper()
+
+	var lsns []int64
+	err := shardLog.Replay(func(record Record) error {
+		lsns = append(lsns, record.LSN)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	for i, lsn := range lsns {
+		if lsn != int64(i)+1 {
+			t.Fatalf("replayed LSNs %v out of order", lsns)
+		}
+	}
+	return lsns
+}
+
+func frameOf(t *testing.T, lsn int64) []byte {
+	t.Helper()
+
+	frame, err := encodeRecord(Record{LSN: lsn, Term: 1, Timestamp: time.Now(), Op: "write", Shard: "sh1"})
+	if err != nil {
+		t.Fatalf("encodeRecord: %v", err)
+	}
+	return frame
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+func truncateBy(t *testing.T, path string, n int64) {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	if err := os.Truncate(path, info.Size()-n); err != nil {
+		t.Fatalf("truncating %s: %v", path, err)
+	}
+}
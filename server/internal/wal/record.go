@@ -0,0 +1,230 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Every segment starts with SEGMENT_MAGIC followed by the format version as a
+// little-endian uint32. Records follow as frames of
+//
+//	length (uint32) | crc32c of body (uint32) | body
+//
+// where the body holds the LSN, the timestamp in Unix nanoseconds, the term
+// (since version 2), and the length-prefixed op, shard, idempotency key
+// (since version 3) and payload. Segments of earlier versions are still read,
+// with every record of version 1 in term 0.
+const (
+	SEGMENT_MAGIC     = "GWAL"
+	FORMAT_VERSION    = 3
+	HEADER_SIZE       = 8
+	FRAME_HEADER_SIZE = 8
+	MAX_RECORD_SIZE   = 64 * 1024 * 1024
+)
+
+var (
+	ErrTruncatedRecord = errors.New("truncated WAL record")
+	ErrCorruptRecord   = errors.New("corrupt WAL record")
+	ErrRecordTooLarge  = errors.New("WAL record too large")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type Record struct {
+	LSN       int64           `json:"lsn"`
+	Term      int64           `json:"term"`
+	Timestamp time.Time       `json:"timestamp"`
+	Op        string          `json:"op"`
+	Shard     string          `json:"shard"`
+	Key       string          `json:"key,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// CorruptionError reports where in a segment the first unreadable record
+// starts.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v in %s at offset %d", e.Err, e.Path, e.Offset)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func segmentHeader() []byte {
+	header := make([]byte, HEADER_SIZE)
+	copy(header, SEGMENT_MAGIC)
+	binary.LittleEndian.PutUint32(header[4:], FORMAT_VERSION)
+	return header
+}
+
+// readSegmentHeader checks the segment header and returns its format
+// version.
+func readSegmentHeader(r io.Reader) (uint32, error) {
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, ErrTruncatedRecord
+		}
+		return 0, err
+	}
+	if string(header[:4]) != SEGMENT_MAGIC {
+		return 0, fmt.Errorf("%w: bad segment magic %q", ErrCorruptRecord, header[:4])
+	}
+	version := binary.LittleEndian.Uint32(header[4:])
+	if version < 1 || version > FORMAT_VERSION {
+		return 0, fmt.Errorf("unsupported WAL format version %d", version)
+	}
+	return version, nil
+}
+
+// encodeRecord returns the frame of a record. It fails with
+// ErrRecordTooLarge for records that could not be read back: the op, shard
+// and key must each fit their uint16 length, and the body MAX_RECORD_SIZE.
+func encodeRecord(record Record) ([]byte, error) {
+	for _, field := range []string{record.Op, record.Shard, record.Key} {
+		if len(field) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: field of %d bytes exceeds limit", ErrRecordTooLarge, len(field))
+		}
+	}
+	bodySize := 8 + 8 + 8 + 2 + len(record.Op) + 2 + len(record.Shard) + 2 + len(record.Key) + 4 + len(record.Payload)
+	if bodySize > MAX_RECORD_SIZE {
+		return nil, fmt.Errorf("%w: record length %d exceeds limit", ErrRecordTooLarge, bodySize)
+	}
+	frame := make([]byte, FRAME_HEADER_SIZE+bodySize)
+
+	body := frame[FRAME_HEADER_SIZE:]
+	binary.LittleEndian.PutUint64(body[0:], uint64(record.LSN))
+	binary.LittleEndian.PutUint64(body[8:], uint64(record.Timestamp.UnixNano()))
+	binary.LittleEndian.PutUint64(body[16:], uint64(record.Term))
+	offset := 24
+	offset += putBytes16(body[offset:], []byte(record.Op))
+	offset += putBytes16(body[offset:], []byte(record.Shard))
+	offset += putBytes16(body[offset:], []byte(record.Key))
+	binary.LittleEndian.PutUint32(body[offset:], uint32(len(record.Payload)))
+	copy(body[offset+4:], record.Payload)
+
+	binary.LittleEndian.PutUint32(frame[0:], uint32(bodySize))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(body, crcTable))
+	return frame, nil
+}
+
+func putBytes16(buf []byte, value []byte) int {
+	binary.LittleEndian.PutUint16(buf, uint16(len(value)))
+	copy(buf[2:], value)
+	return 2 + len(value)
+}
+
+// readRecord reads the next frame of a segment of the given format version.
+// It returns io.EOF only when the reader ends exactly on a frame boundary,
+// and the size of the frame otherwise.
+func readRecord(r *bufio.Reader, version uint32) (Record, int, error) {
+	frameHeader := make([]byte, FRAME_HEADER_SIZE)
+	n, err := io.ReadFull(r, frameHeader)
+	if errors.Is(err, io.EOF) {
+		return Record{}, 0, io.EOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return Record{}, n, ErrTruncatedRecord
+	}
+	if err != nil {
+		return Record{}, n, err
+	}
+
+	size := binary.LittleEndian.Uint32(frameHeader[0:])
+	checksum := binary.LittleEndian.Uint32(frameHeader[4:])
+	if size > MAX_RECORD_SIZE {
+		return Record{}, n, fmt.Errorf("%w: record length %d exceeds limit", ErrCorruptRecord, size)
+	}
+
+	body := make([]byte, size)
+	m, err := io.ReadFull(r, body)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Record{}, n + m, ErrTruncatedRecord
+	}
+	if err != nil {
+		return Record{}, n + m, err
+	}
+	if crc32.Checksum(body, crcTable) != checksum {
+		return Record{}, n + m, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+
+	record, err := decodeRecordBody(body, version)
+	if err != nil {
+		return Record{}, n + m, err
+	}
+	return record, n + m, nil
+}
+
+func decodeRecordBody(body []byte, version uint32) (Record, error) {
+	fixedSize := 16
+	if version >= 2 {
+		fixedSize = 24
+	}
+	if len(body) < fixedSize {
+		return Record{}, fmt.Errorf("%w: record body too short", ErrCorruptRecord)
+	}
+
+	var record Record
+	record.LSN = int64(binary.LittleEndian.Uint64(body[0:]))
+	record.Timestamp = time.Unix(0, int64(binary.LittleEndian.Uint64(body[8:])))
+	if version >= 2 {
+		record.Term = int64(binary.LittleEndian.Uint64(body[16:]))
+	}
+	rest := body[fixedSize:]
+
+	op, rest, err := readBytes16(rest)
+	if err != nil {
+		return Record{}, err
+	}
+	shard, rest, err := readBytes16(rest)
+	if err != nil {
+		return Record{}, err
+	}
+	var key []byte
+	if version >= 3 {
+		key, rest, err = readBytes16(rest)
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	if len(rest) < 4 {
+		return Record{}, fmt.Errorf("%w: record body too short", ErrCorruptRecord)
+	}
+	payloadSize := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint32(len(rest)) != payloadSize {
+		return Record{}, fmt.Errorf("%w: payload length mismatch", ErrCorruptRecord)
+	}
+
+	record.Op = string(op)
+	record.Shard = string(shard)
+	record.Key = string(key)
+	if payloadSize > 0 {
+		record.Payload = json.RawMessage(rest)
+	}
+	return record, nil
+}
+
+func readBytes16(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, fmt.Errorf("%w: record body too short", ErrCorruptRecord)
+	}
+	size := int(binary.LittleEndian.Uint16(buf))
+	if len(buf) < 2+size {
+		return nil, nil, fmt.Errorf("%w: record body too short", ErrCorruptRecord)
+	}
+	return buf[2 : 2+size], buf[2+size:], nil
+}
@@ -0,0 +1,178 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		record Record
+	}{
+		{
+			name: "write",
+			record: Record{
+				LSN:       1,
+				Term:      2,
+				Timestamp: time.Unix(0, 1700000000123456789),
+				Op:        "write",
+				Shard:     "sh1",
+				Key:       "request-1",
+				Payload:   json.RawMessage(`{"data":[{"Stud_id":1}]}`),
+			},
+		},
+		{
+			name: "no key or payload",
+			record: Record{
+				LSN:       42,
+				Term:      7,
+				Timestamp: time.Unix(0, 1),
+				Op:        "noop",
+				Shard:     "sh2",
+			},
+		},
+		{
+			name: "longest fields",
+			record: Record{
+				LSN:       math.MaxInt64,
+				Term:      math.MaxInt64,
+				Timestamp: time.Unix(0, 0),
+				Op:        strings.Repeat("o", math.MaxUint16),
+				Shard:     strings.Repeat("s", math.MaxUint16),
+				Key:       strings.Repeat("k", math.MaxUint16),
+				Payload:   json.RawMessage(`"` + strings.Repeat("p", 1<<20) + `"`),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := encodeRecord(test.record)
+			if err != nil {
+				t.Fatalf("encodeRecord: %v", err)
+			}
+
+			record, size, err := readRecord(bufio.NewReader(bytes.NewReader(frame)), FORMAT_VERSION)
+			if err != nil {
+				t.Fatalf("readRecord: %v", err)
+			}
+			if size != len(frame) {
+				t.Errorf("read %d bytes of a %d byte frame", size, len(frame))
+			}
+			if !reflect.DeepEqual(record, test.record) {
+				t.Errorf("read back a different record:\ngot  %+v\nwant %+v", summarize(record), summarize(test.record))
+			}
+		})
+	}
+}
+
+func TestEncodeRecordRejectsOversizedFields(t *testing.T) {
+	tooLong := strings.Repeat("x", math.MaxUint16+1)
+
+	tests := []struct {
+		name   string
+		record Record
+	}{
+		{name: "op", record: Record{Op: tooLong, Shard: "sh1"}},
+		{name: "shard", record: Record{Op: "write", Shard: tooLong}},
+		{name: "key", record: Record{Op: "write", Shard: "sh1", Key: tooLong}},
+		{name: "payload", record: Record{Op: "write", Shard: "sh1", Payload: make(json.RawMessage, MAX_RECORD_SIZE)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := encodeRecord(test.record)
+			if !errors.Is(err, ErrRecordTooLarge) {
+				t.Fatalf("encodeRecord returned %d bytes and error %v, want ErrRecordTooLarge", len(frame), err)
+			}
+		})
+	}
+}
+
+func TestReadRecordDetectsDamage(t *testing.T) {
+	frame, err := encodeRecord(Record{
+		LSN:       3,
+		Term:      1,
+		Timestamp: time.Unix(0, 1700000000000000000),
+		Op:        "write",
+		Shard:     "sh1",
+		Payload:   json.RawMessage(`{"data":[]}`),
+	})
+	if err != nil {
+		t.Fatalf("encodeRecord: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		damage  func(frame []byte) []byte
+		wantErr error
+	}{
+		{
+			name:    "nothing left",
+			damage:  func(frame []byte) []byte { return nil },
+			wantErr: io.EOF,
+		},
+		{
+			name:    "torn frame header",
+			damage:  func(frame []byte) []byte { return frame[:FRAME_HEADER_SIZE-3] },
+			wantErr: ErrTruncatedRecord,
+		},
+		{
+			name:    "torn body",
+			damage:  func(frame []byte) []byte { return frame[:len(frame)-1] },
+			wantErr: ErrTruncatedRecord,
+		},
+		{
+			name: "flipped payload byte",
+			damage: func(frame []byte) []byte {
+				frame[len(frame)-2] ^= 0xff
+				return frame
+			},
+			wantErr: ErrCorruptRecord,
+		},
+		{
+			name: "length past the limit",
+			damage: func(frame []byte) []byte {
+				binary.LittleEndian.PutUint32(frame, MAX_RECORD_SIZE+1)
+				return frame
+			},
+			wantErr: ErrCorruptRecord,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			damaged := test.damage(append([]byte(nil), frame...))
+
+			_, _, err := readRecord(bufio.NewReader(bytes.NewReader(damaged)), FORMAT_VERSION)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("readRecord returned error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// summarize shortens the fields of a record so that failures stay readable.
+func summarize(record Record) Record {
+	shorten := func(s string) string {
+		if len(s) > 32 {
+			return s[:32] + "..."
+		}
+		return s
+	}
+	record.Op = shorten(record.Op)
+	record.Shard = shorten(record.Shard)
+	record.Key = shorten(record.Key)
+	record.Payload = json.RawMessage(shorten(string(record.Payload)))
+	return record
+}
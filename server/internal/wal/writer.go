@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("WAL is closed")
+
+// appendRequest is either a new operation, which the writer assigns the next
+// LSN, or a replicated record that must keep the LSN it already has.
+type appendRequest struct {
+	log        *Log
+	term       int64
+	op         string
+	key        string
+	payload    []byte
+	replicated bool
+	record     Record
+	err        error
+	done       chan struct{}
+}
+
+// groupWriter is the single goroutine that appends to every log of a
+// manager. Appends that arrive while it is busy, or within the configured
+// window, are written as one batch and share one fsync per log.
+type groupWriter struct {
+	requests chan *appendRequest
+	window   time.Duration
+	maxBatch int
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newGroupWriter(window time.Duration, maxBatch int) *groupWriter {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+
+	return &groupWriter{
+		requests: make(chan *appendRequest),
+		window:   window,
+		maxBatch: maxBatch,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (g *groupWriter) submit(request *appendRequest) error {
+	select {
+	case g.requests <- request:
+		return nil
+	case <-g.stop:
+		return ErrClosed
+	}
+}
+
+func (g *groupWriter) close() {
+	close(g.stop)
+	<-g.stopped
+}
+
+func (g *groupWriter) run() {
+	defer close(g.stopped)
+
+	for {
+		select {
+		case request := <-g.requests:
+			g.commit(g.collect(request))
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// collect gathers the appends that will share a batch with first.
+func (g *groupWriter) collect(first *appendRequest) []*appendRequest {
+	batch := []*appendRequest{first}
+
+	var timeout <-chan time.Time
+	if g.window > 0 {
+		timer := time.NewTimer(g.window)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < g.maxBatch {
+		if timeout == nil {
+			select {
+			case request := <-g.requests:
+				batch = append(batch, request)
+			default:
+				return batch
+			}
+			continue
+		}
+
+		select {
+		case request := <-g.requests:
+			batch = append(batch, request)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (g *groupWriter) commit(batch []*appendRequest) {
+	var logs []*Log
+	pending := make(map[*Log][]*appendRequest)
+	for _, request := range batch {
+		if _, ok := pending[request.log]; !ok {
+			logs = append(logs, request.log)
+		}
+		pending[request.log] = append(pending[request.log], request)
+	}
+
+	for _, l := range logs {
+		err := l.commit(pending[l])
+		for _, request := range pending[l] {
+			if err != nil {
+				request.err = err
+			}
+			close(request.done)
+		}
+	}
+}
@@ -5,14 +5,37 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/raft"
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
 )
 
-var db *sql.DB
+var (
+	db         *sql.DB
+	walManager *wal.Manager
+	archiver   wal.Archiver
+	shardLocks sync.Map
+	raftNodes  sync.Map
+	raftStore  *raftStorage
+
+	// applyWaiters holds the applyWaiter of the write that is waiting for
+	// its record to apply on each shard this server leads. Writes hold their
+	// shard's lock, so there is at most one per shard.
+	applyWaiters sync.Map
+
+	replicationClient = &http.Client{}
+	antiEntropy       = newAntiEntropyTracker()
+)
 
 func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -45,19 +68,22 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, shard := range reqBody.Shards {
-		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ( ", shard)
-		for i, col := range reqBody.Schema.Columns {
-			query += fmt.Sprintf("%s %s", col, reqBody.Schema.Dtypes[i])
-			if i < len(reqBody.Schema.Columns)-1 {
-				query += ", "
-			}
-		}
-		query += ")"
-		_, err = db.Exec(query)
+		err = configureShard(ShardConfigRequest{Shard: shard, Schema: reqBody.Schema})
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error creating table: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if err := setStandalone(shard, reqBody.Standalone); err != nil {
+			http.Error(w, fmt.Sprintf("Error configuring shard %s: %v", shard, err), http.StatusInternalServerError)
+			return
+		}
+		if reqBody.Standalone {
+			continue
+		}
+		if err := startRaftNode(shard); err != nil {
+			http.Error(w, fmt.Sprintf("Error starting Raft node of shard %s: %v", shard, err), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -115,11 +141,29 @@ func writeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
 		return
 	}
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	shard := reqBody.Shard
-	synReplication(shard, reqBody, "POST", "/write", w)
+	unlock := lockShard(shard)
+	defer unlock()
+
+	if err := checkPrepared(shard, rowStudIDs(reqBody.Data)); err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
 
-	if err := writeDataToShard(db, reqBody); err != nil {
-		http.Error(w, "Error committing to database", http.StatusInternalServerError)
+	lsn, err := synReplication(shard, reqBody, epoch, key)
+	if err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
 		return
 	}
 
@@ -127,6 +171,7 @@ func writeHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(WriteResponse{
 		Message: "Data entries added",
+		LSN:     lsn,
 		Status:  "success",
 	})
 }
@@ -145,16 +190,18 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	shard := reqBody.Shard
-	query := fmt.Sprintf("SELECT Stud_id, Stud_name, Stud_marks FROM %s WHERE Stud_id BETWEEN %d AND %d", shard, reqBody.StudID.Low, reqBody.StudID.High)
-
-	data, err := fetchDataFromShard(db, query)
+	if node, ok := getRaftNode(shard); ok && reqBody.MinLSN > 0 {
+		waitApplied(node, reqBody.MinLSN, getEnvDuration("READ_WAIT_TIMEOUT", READ_WAIT_TIMEOUT))
+	}
+	snapshot, err := readShardRange(shard, reqBody.StudID.Low, reqBody.StudID.High)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error fetching data from shard %s: %v", shard, err), http.StatusInternalServerError)
 		return
 	}
 
 	response := ReadResponse{
-		Data:   data,
+		Data:   snapshot.Data,
+		LSN:    snapshot.LSN,
 		Status: "success",
 	}
 
@@ -176,18 +223,41 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	shard := reqBody.Shard
-	synReplication(shard, reqBody, "PUT", "/update", w)
-	query := fmt.Sprintf("UPDATE %s SET Stud_marks = ? WHERE Stud_id = ?", shard)
+	unlock := lockShard(shard)
+	defer unlock()
+
+	if err := checkPrepared(shard, []int{reqBody.StudID}); err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
 
-	_, err = db.Exec(query, reqBody.Data.StudentMarks, reqBody.StudID)
+	reqBody.Before, err = fetchRow(shard, reqBody.StudID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error updating data in shard %s for Stud_id %d: %v", shard, reqBody.StudID, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error reading Stud_id %d from shard %s: %v", reqBody.StudID, shard, err), http.StatusInternalServerError)
 		return
 	}
 
-	resp := make(map[string]string)
+	lsn, err := synReplication(shard, reqBody, epoch, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating data in shard %s for Stud_id %d: %v", shard, reqBody.StudID, err), replicationStatus(err))
+		return
+	}
+
+	resp := make(map[string]interface{})
 	resp["message"] = fmt.Sprintf("Data entry for Stud_id:%d updated", reqBody.StudID)
+	resp["lsn"] = lsn
 	resp["status"] = "success"
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -207,24 +277,231 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	shard := reqBody.Shard
-	synReplication(shard, reqBody, "DELETE", "/delete", w)
-	query := fmt.Sprintf("DELETE FROM %s WHERE Stud_id = ?", shard)
+	unlock := lockShard(shard)
+	defer unlock()
+
+	if err := checkPrepared(shard, []int{reqBody.StudID}); err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
 
-	_, err = db.Exec(query, reqBody.StudID)
+	reqBody.Before, err = fetchRow(shard, reqBody.StudID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting data in shard %s for Stud_id %d: %v", reqBody.Shard, reqBody.StudID, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error reading Stud_id %d from shard %s: %v", reqBody.StudID, shard, err), http.StatusInternalServerError)
 		return
 	}
 
-	resp := make(map[string]string)
+	lsn, err := synReplication(shard, reqBody, epoch, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting data in shard %s for Stud_id %d: %v", reqBody.Shard, reqBody.StudID, err), replicationStatus(err))
+		return
+	}
+
+	resp := make(map[string]interface{})
 	resp["message"] = fmt.Sprintf("Data entry with Stud_id:%d removed", reqBody.StudID)
+	resp["lsn"] = lsn
 	resp["status"] = "success"
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// prepareHandler is the first phase of a transaction on the shard. Preparing
+// a transaction that is already prepared succeeds without logging anything.
+func prepareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody PrepareRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateTxnOps(reqBody.Ops); err != nil {
+		http.Error(w, fmt.Sprintf("Error in transaction %s: %v", reqBody.TxID, err), http.StatusBadRequest)
+		return
+	}
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shard := reqBody.Shard
+	unlock := lockShard(shard)
+	defer unlock()
+
+	_, prepared, err := resolvableTxn(shard, reqBody.TxID, epoch)
+	if err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
+
+	// A transaction retrying one already committed under the same
+	// idempotency key is not prepared, so that committing it changes nothing.
+	var lsn int64
+	if key != "" && !prepared {
+		lsn, prepared, err = appliedKey(shard, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !prepared {
+		if err := checkPrepared(shard, txnStudIDs(reqBody.Ops)); err != nil {
+			http.Error(w, err.Error(), replicationStatus(err))
+			return
+		}
+		lsn, err = synReplication(shard, reqBody, epoch, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error preparing transaction %s in shard %s: %v", reqBody.TxID, shard, err), replicationStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(WriteResponse{
+		Message: fmt.Sprintf("Transaction %s prepared", reqBody.TxID),
+		LSN:     lsn,
+		Status:  "success",
+	})
+}
+
+// commitHandler commits a transaction prepared on the shard. A transaction
+// that is not prepared has already been resolved, and committing it again
+// succeeds without logging anything.
+func commitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody CommitRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		return
+	}
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shard := reqBody.Shard
+	unlock := lockShard(shard)
+	defer unlock()
+
+	txn, prepared, err := resolvableTxn(shard, reqBody.TxID, epoch)
+	if err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
+
+	var lsn int64
+	if prepared {
+		reqBody.Ops = txn.Ops
+		for i, op := range reqBody.Ops {
+			if op.Op == WAL_OP_WRITE {
+				continue
+			}
+			reqBody.Ops[i].Before, err = fetchRow(shard, op.StudID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error reading Stud_id %d from shard %s: %v", op.StudID, shard, err), http.StatusInternalServerError)
+				return
+			}
+		}
+		lsn, err = synReplication(shard, reqBody, epoch, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error committing transaction %s in shard %s: %v", reqBody.TxID, shard, err), replicationStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(WriteResponse{
+		Message: fmt.Sprintf("Transaction %s committed", reqBody.TxID),
+		LSN:     lsn,
+		Status:  "success",
+	})
+}
+
+// abortHandler aborts a transaction prepared on the shard. Aborting a
+// transaction that is not prepared succeeds without logging anything, so
+// that a transaction the coordinator lost track of can be aborted blindly.
+func abortHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody AbortRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		return
+	}
+	epoch, err := requestEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shard := reqBody.Shard
+	unlock := lockShard(shard)
+	defer unlock()
+
+	_, prepared, err := resolvableTxn(shard, reqBody.TxID, epoch)
+	if err != nil {
+		http.Error(w, err.Error(), replicationStatus(err))
+		return
+	}
+
+	var lsn int64
+	if prepared {
+		lsn, err = synReplication(shard, reqBody, epoch, "")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error aborting transaction %s in shard %s: %v", reqBody.TxID, shard, err), replicationStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(WriteResponse{
+		Message: fmt.Sprintf("Transaction %s aborted", reqBody.TxID),
+		LSN:     lsn,
+		Status:  "success",
+	})
+}
+
 func walLengthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
@@ -237,18 +514,680 @@ func walLengthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(walLength)
 }
 
-func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "galaxy.db")
+func walPositionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(walManager.Positions())
+}
+
+func walExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	shardLog, ok := walManager.Get(shard)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No WAL found for shard %q", shard), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if err := shardLog.ExportJSON(w); err != nil {
+		log.Printf("Error exporting WAL of shard %s: %v\n", shard, err)
+	}
+}
+
+// errStreamEnd stops a WAL stream at the last committed record.
+var errStreamEnd = errors.New("end of committed WAL")
+
+func walStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	shardLog, ok := walManager.Get(shard)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No WAL found for shard %q", shard), http.StatusNotFound)
+		return
+	}
+
+	from := int64(1)
+	if rawFrom := r.URL.Query().Get("from"); rawFrom != "" {
+		var err error
+		from, err = strconv.ParseInt(rawFrom, 10, 64)
+		if err != nil || from < 1 {
+			http.Error(w, fmt.Sprintf("Invalid WAL position %q", rawFrom), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if from < shardLog.FirstLSN() && from <= shardLog.LastLSN() {
+		http.Error(w, fmt.Sprintf("WAL of shard %s is only retained from LSN %d", shard, shardLog.FirstLSN()), http.StatusGone)
+		return
+	}
+
+	// Only committed records are streamed, since the others may still be
+	// replaced by a new leader.
+	commit := shardLog.LastLSN()
+	if node, ok := getRaftNode(shard); ok {
+		commit = node.Status().CommitLSN
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	err := shardLog.ReadFrom(from, func(record wal.Record) error {
+		if record.LSN > commit {
+			return errStreamEnd
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStreamEnd) {
+		log.Printf("Error streaming WAL of shard %s from LSN %d: %v\n", shard, from, err)
+	}
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	snapshot, err := takeSnapshot(shard)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, fmt.Sprintf("Error taking snapshot of shard %s: %v", shard, err), http.StatusInternalServerError)
+		return
 	}
-	defer db.Close()
 
-	err = db.Ping()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+func loadSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody Snapshot
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := loadSnapshot(reqBody); err != nil {
+		http.Error(w, fmt.Sprintf("Error loading snapshot of shard %s: %v", reqBody.Shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make(map[string]string)
+	resp["message"] = fmt.Sprintf("Snapshot of %s loaded at LSN %d", reqBody.Shard, reqBody.LSN)
+	resp["status"] = "success"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// pointInTimeHandler returns the rows of a shard as they were at the given
+// lsn or timestamp, rebuilt from a stored snapshot and the WAL.
+func pointInTimeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	var lsn int64
+	var timestamp time.Time
+	var err error
+	if r.URL.Query().Get("lsn") != "" {
+		lsn, err = strconv.ParseInt(r.URL.Query().Get("lsn"), 10, 64)
+		if err != nil || lsn <= 0 {
+			http.Error(w, "Invalid lsn", http.StatusBadRequest)
+			return
+		}
+	} else {
+		timestamp, err = time.Parse(time.RFC3339Nano, r.URL.Query().Get("timestamp"))
+		if err != nil {
+			http.Error(w, "Invalid or missing timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	point, err := restorePointInTime(shard, lsn, timestamp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring shard %s: %v", shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(point)
+}
+
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody RestoreRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if reqBody.LSN <= 0 && reqBody.Timestamp.IsZero() {
+		http.Error(w, "Either lsn or timestamp is required", http.StatusBadRequest)
+		return
+	}
+
+	point, err := restoreShard(reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring shard %s: %v", reqBody.Shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make(map[string]interface{})
+	resp["message"] = fmt.Sprintf("Shard %s restored into %s at LSN %d", reqBody.Shard, reqBody.TargetShard, point.LSN)
+	resp["shard"] = reqBody.TargetShard
+	resp["lsn"] = point.LSN
+	resp["timestamp"] = point.Timestamp
+	resp["rows"] = len(point.Data)
+	resp["status"] = "success"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// changesHandler streams the row changes of a shard as Server-Sent Events,
+// read from its WAL. Every event's id is its position, so a client resumes
+// after the last event it saw by passing it as from or Last-Event-ID. Without
+// a position the feed starts at the last applied record, which is announced
+// in a position event. Records are only sent once they are applied. low and
+// high restrict the feed to a Stud_id range.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	shardLog, ok := walManager.Get(shard)
+	node, running := getRaftNode(shard)
+	if !ok || !running {
+		http.Error(w, fmt.Sprintf("No WAL for shard %s", shard), http.StatusNotFound)
+		return
+	}
+
+	position, _ := node.Applied()
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = r.Header.Get("Last-Event-ID")
+	}
+	if from != "" {
+		var err error
+		position, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || position < 0 {
+			http.Error(w, "Invalid from position", http.StatusBadRequest)
+			return
+		}
+	}
+
+	low, high := math.MinInt, math.MaxInt
+	if r.URL.Query().Get("low") != "" {
+		var err error
+		low, err = strconv.Atoi(r.URL.Query().Get("low"))
+		if err != nil {
+			http.Error(w, "Invalid low", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Query().Get("high") != "" {
+		var err error
+		high, err = strconv.Atoi(r.URL.Query().Get("high"))
+		if err != nil {
+			http.Error(w, "Invalid high", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if position+1 < shardLog.FirstLSN() {
+		http.Error(w, fmt.Sprintf("WAL of shard %s starts at LSN %d", shard, shardLog.FirstLSN()), http.StatusGone)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(map[string]interface{}{"shard": shard, "position": position})
+	fmt.Fprintf(w, "id: %d\nevent: position\ndata: %s\n\n", position, data)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(CHANGE_FEED_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		applied, changed := node.Applied()
+		if applied <= position {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			case <-changed:
+			}
+			continue
+		}
+
+		err := shardLog.ReadFrom(position+1, func(record wal.Record) error {
+			if record.LSN > applied {
+				return errStreamEnd
+			}
+			events, err := changeEvents(record)
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				if event.StudID < low || event.StudID > high {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", event.Position, data); err != nil {
+					return err
+				}
+			}
+			position = record.LSN
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStreamEnd) {
+			data, _ := json.Marshal(err.Error())
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// replicationLagHandler reports, for every shard this server leads, the last
+// WAL position each follower acknowledged, when it did, and how far behind it
+// is in records and in seconds.
+func replicationLagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lag := make(map[string]map[int]ReplicaLag)
+	raftNodes.Range(func(shard, node interface{}) bool {
+		if shardLag := replicationLag(shard.(string), node.(*raft.Node)); len(shardLag) != 0 {
+			lag[shard.(string)] = shardLag
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lag)
+}
+
+// raftStatusHandler reports the role, term and leader of every shard's Raft
+// node, or of the one given by shard.
+func raftStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make(map[string]raft.Status)
+	raftNodes.Range(func(shard, node interface{}) bool {
+		if r.URL.Query().Get("shard") == "" || r.URL.Query().Get("shard") == shard {
+			statuses[shard.(string)] = node.(*raft.Node).Status()
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func raftVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody raft.VoteRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	node, ok := getRaftNode(reqBody.Shard)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No Raft node for shard %s", reqBody.Shard), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(node.HandleVote(reqBody))
+}
+
+func raftAppendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody raft.AppendRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	node, ok := getRaftNode(reqBody.Shard)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No Raft node for shard %s", reqBody.Shard), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(node.HandleAppend(reqBody))
+}
+
+// raftSnapshotHandler reloads a shard from a snapshot of its leader, when the
+// leader no longer retains the WAL records this server is missing.
+func raftSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody raft.SnapshotRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	node, ok := getRaftNode(reqBody.Shard)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No Raft node for shard %s", reqBody.Shard), http.StatusNotFound)
+		return
+	}
+
+	response, err := node.HandleSnapshot(reqBody, func() error {
+		log.Printf("Loading snapshot of shard %s from Server%d\n", reqBody.Shard, reqBody.Leader)
+		snapshot, err := fetchSnapshot(reqBody.Shard, reqBody.Leader)
+		if err != nil {
+			return err
+		}
+		return loadSnapshot(snapshot)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading snapshot of shard %s: %v", reqBody.Shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// merkleHandler returns the Merkle tree of a shard's rows and the LSN they
+// reflect, for a follower to compare with its own.
+func merkleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	if _, ok := walManager.Get(shard); !ok {
+		http.Error(w, fmt.Sprintf("No WAL for shard %s", shard), http.StatusNotFound)
+		return
+	}
+
+	tree, err := buildMerkleTree(shard)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building Merkle tree of shard %s: %v", shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tree)
+}
+
+// merkleRangeHandler returns the rows of a shard in a Stud_id range and the
+// LSN they reflect, for a follower to repair the range from.
+func merkleRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard := r.URL.Query().Get("shard")
+	if _, ok := walManager.Get(shard); !ok {
+		http.Error(w, fmt.Sprintf("No WAL for shard %s", shard), http.StatusNotFound)
+		return
+	}
+	low, err := strconv.Atoi(r.URL.Query().Get("low"))
+	if err != nil {
+		http.Error(w, "Invalid low", http.StatusBadRequest)
+		return
+	}
+	high, err := strconv.Atoi(r.URL.Query().Get("high"))
+	if err != nil {
+		http.Error(w, "Invalid high", http.StatusBadRequest)
+		return
+	}
+
+	snapshot, err := readShardRange(shard, low, high)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading shard %s: %v", shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// antiEntropyHandler reports the anti-entropy metrics of every shard this
+// server follows on GET. On POST it runs a round on the given shards, or on
+// all of them, right away.
+func antiEntropyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var reqBody CheckpointRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		shards := reqBody.Shards
+		if len(shards) == 0 {
+			shards = walManager.Shards()
+		}
+		for _, shard := range shards {
+			if _, err := antiEntropyRound(shard); err != nil {
+				antiEntropy.failed(shard, err)
+				http.Error(w, fmt.Sprintf("Error running anti-entropy on shard %s: %v", shard, err), http.StatusInternalServerError)
+				return
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(antiEntropy.snapshot())
+}
+
+func catchUpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody CatchUpRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	records, err := catchUpShard(reqBody.Shard, reqBody.Source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error catching up shard %s from Server%d: %v", reqBody.Shard, reqBody.Source, err), http.StatusInternalServerError)
+		return
+	}
+
+	shardLog, err := walManager.Log(reqBody.Shard)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening WAL of shard %s: %v", reqBody.Shard, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CatchUpResponse{
+		Shard:   reqBody.Shard,
+		LSN:     shardLog.LastLSN(),
+		Records: records,
+		Status:  "success",
+	})
+}
+
+func checkpointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody CheckpointRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	shards := reqBody.Shards
+	if len(shards) == 0 {
+		shards = walManager.Shards()
+	}
+
+	checkpoints := make(map[string]int64)
+	for _, shard := range shards {
+		lsn, err := checkpointShard(shard)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checkpointing shard %s: %v", shard, err), http.StatusInternalServerError)
+			return
+		}
+		checkpoints[shard] = lsn
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(checkpoints)
+}
+
+func main() {
+	var err error
+	db, err = sql.Open("sqlite3", "galaxy.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Ping()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	archiver = newArchiver()
+	walManager, err = wal.NewManager(WAL_DIRECTORY_PATH, wal.Config{
+		SegmentSize:         WAL_SEGMENT_SIZE,
+		GroupCommitWindow:   getEnvDuration("WAL_GROUP_COMMIT_WINDOW", WAL_GROUP_COMMIT_WINDOW),
+		GroupCommitMaxBatch: getEnvInt("WAL_GROUP_COMMIT_MAX_BATCH", WAL_GROUP_COMMIT_MAX_BATCH),
+		Archiver:            archiver,
+	})
+	if err != nil {
+		log.Fatalf("error opening WAL: %s\n", err)
+	}
+	defer walManager.Close()
+
+	err = createPreparedTxnsTable(db)
+	if err != nil {
+		log.Fatalf("error opening prepared transactions: %s\n", err)
+	}
+	err = createIdempotencyKeysTable(db)
+	if err != nil {
+		log.Fatalf("error opening idempotency keys: %s\n", err)
+	}
+
+	raftStore, err = newRaftStorage(db)
+	if err != nil {
+		log.Fatalf("error opening Raft state: %s\n", err)
+	}
+
+	err = recoverFromWAL(db)
+	if err != nil {
+		log.Fatalf("error recovering from WAL: %s\n", err)
+	}
+	for _, shard := range walManager.Shards() {
+		standalone, err := isStandalone(shard)
+		if err != nil {
+			log.Fatalf("error reading shard %s: %s\n", shard, err)
+		}
+		if standalone {
+			continue
+		}
+		if err := startRaftNode(shard); err != nil {
+			log.Fatalf("error starting Raft node of shard %s: %s\n", shard, err)
+		}
 	}
+	go checkpointPeriodically()
+	go antiEntropyPeriodically()
 
 	http.HandleFunc("/heartbeat", heartbeatHandler)
 	http.HandleFunc("/config", configHandler)
@@ -257,7 +1196,28 @@ func main() {
 	http.HandleFunc("/write", writeHandler)
 	http.HandleFunc("/update", updateHandler)
 	http.HandleFunc("/delete", deleteHandler)
+	http.HandleFunc("/prepare", prepareHandler)
+	http.HandleFunc("/commit", commitHandler)
+	http.HandleFunc("/abort", abortHandler)
 	http.HandleFunc("/wal_length", walLengthHandler)
+	http.HandleFunc("/wal_position", walPositionHandler)
+	http.HandleFunc("/checkpoint", checkpointHandler)
+	http.HandleFunc("/wal_export", walExportHandler)
+	http.HandleFunc("/wal_stream", walStreamHandler)
+	http.HandleFunc("/catch_up", catchUpHandler)
+	http.HandleFunc("/snapshot", snapshotHandler)
+	http.HandleFunc("/load_snapshot", loadSnapshotHandler)
+	http.HandleFunc("/point_in_time", pointInTimeHandler)
+	http.HandleFunc("/restore", restoreHandler)
+	http.HandleFunc("/changes", changesHandler)
+	http.HandleFunc("/replication_lag", replicationLagHandler)
+	http.HandleFunc("/raft_status", raftStatusHandler)
+	http.HandleFunc("/merkle", merkleHandler)
+	http.HandleFunc("/merkle_range", merkleRangeHandler)
+	http.HandleFunc("/anti_entropy", antiEntropyHandler)
+	http.HandleFunc("/raft/vote", raftVoteHandler)
+	http.HandleFunc("/raft/append", raftAppendHandler)
+	http.HandleFunc("/raft/snapshot", raftSnapshotHandler)
 
 	log.Println("Starting server on port 5000")
 	err = http.ListenAndServe(":5000", nil)
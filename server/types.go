@@ -1,10 +1,21 @@
 package main
 
-import "time"
+import (
+	"database/sql"
+	"sync"
+	"time"
 
+	"github.com/yatharthsameer/galaxydb/server/internal/merkle"
+	"github.com/yatharthsameer/galaxydb/server/internal/raft"
+)
+
+// ConfigPayload configures shards on the server. Standalone shards are copies
+// kept outside of their replica sets, and never join their Raft groups, not
+// even after the server restarts.
 type ConfigPayload struct {
-	Schema schema   `json:"schema"`
-	Shards []string `json:"shards"`
+	Schema     schema   `json:"schema"`
+	Shards     []string `json:"shards"`
+	Standalone bool     `json:"standalone,omitempty"`
 }
 
 type schema struct {
@@ -23,11 +34,17 @@ type ShardData struct {
 }
 
 type Requester interface {
+	GetOp() string
 	GetShard() string
 	GetShardData() []ShardData
 	GetStudID() int
 }
 
+type ShardConfigRequest struct {
+	Shard  string `json:"shard"`
+	Schema schema `json:"schema"`
+}
+
 type WriteRequest struct {
 	Shard string      `json:"shard"`
 	Data  []ShardData `json:"data"`
@@ -35,38 +52,188 @@ type WriteRequest struct {
 
 type WriteResponse struct {
 	Message string `json:"message"`
+	LSN     int64  `json:"lsn"`
 	Status  string `json:"status"`
 }
 
+// ReadRequest waits for the replica to have applied MinLSN, if set, before
+// reading.
 type ReadRequest struct {
 	Shard  string `json:"shard"`
 	StudID struct {
 		Low  int `json:"low"`
 		High int `json:"high"`
 	} `json:"Stud_id"`
+	MinLSN int64 `json:"min_lsn,omitempty"`
 }
 
+// ReadResponse carries the LSN of the last record applied to the shard when
+// the rows were read, so that readers can tell which replica is the newest.
 type ReadResponse struct {
 	Data   []ShardData `json:"data"`
+	LSN    int64       `json:"lsn"`
 	Status string      `json:"status"`
 }
 
+// UpdateRequest replaces the row of StudID with Data.
 type UpdateRequest struct {
 	Shard  string    `json:"shard"`
 	StudID int       `json:"Stud_id"`
 	Data   ShardData `json:"data"`
+	// Before holds the row as it was when the update was logged, so that
+	// the change feed can report it.
+	Before *ShardData `json:"before,omitempty"`
 }
 
 type DeleteRequest struct {
 	Shard  string `json:"shard"`
 	StudID int    `json:"Stud_id"`
+	// Before holds the row as it was when the delete was logged.
+	Before *ShardData `json:"before,omitempty"`
+}
+
+// TxnOp is one write, update or delete of a transaction. An update carries
+// the new row as the only element of Data.
+type TxnOp struct {
+	Op     string      `json:"op"`
+	StudID int         `json:"Stud_id,omitempty"`
+	Data   []ShardData `json:"data,omitempty"`
+	Before *ShardData  `json:"before,omitempty"`
+}
+
+// PrepareRequest is the first phase of a transaction on a shard. Its
+// operations are set aside, and the Stud_ids they touch locked against any
+// other mutation, until the transaction is committed or aborted.
+type PrepareRequest struct {
+	Shard string  `json:"shard"`
+	TxID  string  `json:"txid"`
+	Ops   []TxnOp `json:"ops"`
+}
+
+// CommitRequest is logged with the operations of the transaction it
+// commits, so that the record alone says what it changes.
+type CommitRequest struct {
+	Shard string  `json:"shard"`
+	TxID  string  `json:"txid"`
+	Ops   []TxnOp `json:"ops,omitempty"`
+}
+
+type AbortRequest struct {
+	Shard string `json:"shard"`
+	TxID  string `json:"txid"`
 }
 
-type WALRecord struct {
-	Timestamp time.Time   `json:"timestamp"`
-	Shard     string      `json:"shard"`
-	Data      []ShardData `json:"data"`
-	StudID    int         `json:"Stud_id"`
+// PreparedTxn is a transaction prepared on a shard and not yet resolved.
+type PreparedTxn struct {
+	TxID string  `json:"txid"`
+	Ops  []TxnOp `json:"ops"`
+}
+
+type CheckpointRequest struct {
+	Shards []string `json:"shards"`
+}
+
+// Term is the Raft term of the record at LSN, so that a replica restarting
+// its WAL at the snapshot can tell whether it agrees with the leader's.
+// Prepared holds the transactions prepared on the shard as of LSN, which a
+// replica needs in order to commit them, and Keys the idempotency keys
+// applied to it, which it needs in order to recognise retries.
+type Snapshot struct {
+	Shard     string        `json:"shard"`
+	LSN       int64         `json:"lsn"`
+	Term      int64         `json:"term"`
+	Timestamp time.Time     `json:"timestamp"`
+	Data      []ShardData   `json:"data"`
+	Prepared  []PreparedTxn `json:"prepared,omitempty"`
+	Keys      []AppliedKey  `json:"keys,omitempty"`
+}
+
+// AppliedKey is an idempotency key applied to a shard by the record at LSN.
+type AppliedKey struct {
+	Key       string    `json:"key"`
+	LSN       int64     `json:"lsn"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// storedSnapshot is a snapshot file kept for point-in-time recovery.
+type storedSnapshot struct {
+	lsn       int64
+	timestamp time.Time
+	path      string
+}
+
+type RestoreRequest struct {
+	Shard       string    `json:"shard"`
+	TargetShard string    `json:"target_shard"`
+	LSN         int64     `json:"lsn"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// ChangeEvent is one row change in the change feed. Position is the LSN of
+// the WAL record it comes from; a write of several rows yields one event per
+// row, all at the same position.
+type ChangeEvent struct {
+	Shard     string     `json:"shard"`
+	Position  int64      `json:"position"`
+	Timestamp time.Time  `json:"timestamp"`
+	Op        string     `json:"op"`
+	StudID    int        `json:"Stud_id"`
+	Before    *ShardData `json:"before"`
+	After     *ShardData `json:"after"`
+}
+
+// ReplicaLag is how far a follower is behind the leader of a shard. Lag in
+// seconds is the age of the oldest record the follower has not acknowledged,
+// and 0 once it has them all.
+type ReplicaLag struct {
+	raft.Progress
+	LagRecords int64   `json:"lag_records"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// MerkleTree is the Merkle tree of a shard's rows as of LSN.
+type MerkleTree struct {
+	Shard string      `json:"shard"`
+	LSN   int64       `json:"lsn"`
+	Tree  merkle.Tree `json:"tree"`
+}
+
+// AntiEntropyStats counts what anti-entropy found and repaired in a shard
+// this server follows. DivergentRanges is the number of Stud_id ranges that
+// differed from the leader in the last round.
+type AntiEntropyStats struct {
+	Rounds               int       `json:"rounds"`
+	LastRound            time.Time `json:"last_round"`
+	LastLSN              int64     `json:"last_lsn"`
+	DivergentRanges      int       `json:"divergent_ranges"`
+	TotalDivergentRanges int       `json:"total_divergent_ranges"`
+	RepairedRanges       int       `json:"repaired_ranges"`
+	RepairedRows         int       `json:"repaired_rows"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+type antiEntropyTracker struct {
+	mutex sync.Mutex
+	stats map[string]*AntiEntropyStats
+}
+
+// applyWaiter collects why the records of a shard failed to apply, by LSN,
+// while a write on the leader waits for its own record.
+type applyWaiter struct {
+	mutex    sync.Mutex
+	failures map[int64]error
+}
+
+type CatchUpRequest struct {
+	Shard  string `json:"shard"`
+	Source int    `json:"source"`
+}
+
+type CatchUpResponse struct {
+	Shard   string `json:"shard"`
+	LSN     int64  `json:"lsn"`
+	Records int    `json:"records"`
+	Status  string `json:"status"`
 }
 
 type ShardServersRequest struct {
@@ -74,6 +241,24 @@ type ShardServersRequest struct {
 }
 
 type ShardServersResponse struct {
-	ServerIDs []int `json:"server_ids"`
-	Primary   int   `json:"primary"`
+	ServerIDs       []int  `json:"servers"`
+	Primary         int    `json:"primary"`
+	ReplicationMode string `json:"replication_mode"`
 }
+
+// LeaderReport tells the shard manager which server leads a shard's Raft
+// group, and since which term.
+type LeaderReport struct {
+	ShardID string `json:"shard_id"`
+	Server  int    `json:"server"`
+	Term    int64  `json:"term"`
+}
+
+// raftStorage keeps the term, vote and commit LSN of every shard's Raft node
+// in the server's database.
+type raftStorage struct {
+	db *sql.DB
+}
+
+// raftTransport sends Raft RPCs to the other servers over HTTP.
+type raftTransport struct{}
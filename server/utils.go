@@ -2,16 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/yatharthsameer/galaxydb/server/internal/merkle"
+	"github.com/yatharthsameer/galaxydb/server/internal/raft"
+	"github.com/yatharthsameer/galaxydb/server/internal/wal"
 )
 
 func fetchDataFromShard(db *sql.DB, query string) ([]ShardData, error) {
@@ -34,12 +47,40 @@ func fetchDataFromShard(db *sql.DB, query string) ([]ShardData, error) {
 	return data, nil
 }
 
-func writeDataToShard(db *sql.DB, request Requester) error {
-	tx, err := db.Begin()
+func createShardTable(tx *sql.Tx, request ShardConfigRequest) error {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ( ", request.Shard)
+	for i, col := range request.Schema.Columns {
+		query += fmt.Sprintf("%s %s", col, request.Schema.Dtypes[i])
+		if i < len(request.Schema.Columns)-1 {
+			query += ", "
+		}
+	}
+	query += ")"
+	_, err := tx.Exec(query)
+	return err
+}
+
+// configureShard logs the shard's schema before creating its table, so that
+// WAL replay can rebuild the table ahead of the writes that depend on it. A
+// shard that already has a WAL is left alone, since its log is shared with
+// the other replicas through Raft from then on.
+func configureShard(request ShardConfigRequest) error {
+	unlock := lockShard(request.Shard)
+	defer unlock()
+
+	if shardLog, ok := walManager.Get(request.Shard); ok && shardLog.LastLSN() > 0 {
+		return nil
+	}
+
+	record, err := writeToWAL(request)
 	if err != nil {
-		return err
+		return fmt.Errorf("error writing to WAL: %w", err)
 	}
-	defer tx.Rollback()
+
+	return applyToShard(db, request, record)
+}
+
+func writeDataToShard(tx *sql.Tx, request Requester) error {
 	reqData := request.GetShardData()
 	reqShard := request.GetShard()
 	for _, entry := range reqData {
@@ -49,236 +90,2247 @@ func writeDataToShard(db *sql.DB, request Requester) error {
 			return err
 		}
 	}
-	err = tx.Commit()
+
+	return nil
+}
+
+func updateDataInShard(tx *sql.Tx, request Requester) error {
+	reqData := request.GetShardData()
+	if len(reqData) == 0 {
+		return fmt.Errorf("%w: no data to update for Stud_id %d", errInvalidRequest, request.GetStudID())
+	}
+	query := fmt.Sprintf("UPDATE %s SET Stud_marks = ? WHERE Stud_id = ?", request.GetShard())
+	_, err := tx.Exec(query, reqData[0].StudentMarks, request.GetStudID())
+	return err
+}
+
+func deleteDataFromShard(tx *sql.Tx, request Requester) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE Stud_id = ?", request.GetShard())
+	_, err := tx.Exec(query, request.GetStudID())
+	return err
+}
+
+// applyToShard applies a logged request to its shard table and records the
+// LSN it was logged at in the same transaction, so that recovery knows where
+// to resume. A request whose idempotency key an earlier record already
+// applied is a retry, and changes nothing.
+func applyToShard(db *sql.DB, request Requester, record wal.Record) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	first := true
+	if record.Key != "" && recordsKey(request.GetOp()) {
+		first, err = claimKey(tx, record)
+		if err != nil {
+			return err
+		}
+	}
+	if first {
+		if err := applyRequest(tx, request); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("WAL record %s:%d retries idempotency key %s, skipping it\n", record.Shard, record.LSN, record.Key)
+		if commit, ok := request.(CommitRequest); ok {
+			// The transaction retries one that was committed already, and
+			// is dropped instead.
+			if _, err := deletePreparedTxn(tx, commit.Shard, commit.TxID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := setAppliedLSN(tx, request.GetShard(), record.LSN); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func writeToWAL(req Requester) error {
-	record := WALRecord{
-		Timestamp: time.Now(),
-		Shard:     req.GetShard(),
-		Data:      req.GetShardData(),
-		StudID:    req.GetStudID(),
+// recordsKey reports whether the records of op are deduplicated by their
+// idempotency key. Prepares and aborts are not: a transaction retried after
+// being aborted must be prepared again, and only its commit is final.
+func recordsKey(op string) bool {
+	switch op {
+	case WAL_OP_WRITE, WAL_OP_UPDATE, WAL_OP_DELETE, WAL_OP_COMMIT:
+		return true
 	}
+	return false
+}
 
-	recordData, err := json.Marshal(record)
+// claimKey records that the record applies its idempotency key, and reports
+// whether no earlier record had.
+func claimKey(tx *sql.Tx, record wal.Record) (bool, error) {
+	result, err := tx.Exec("INSERT OR IGNORE INTO idempotency_keys (shard, key, lsn, timestamp) VALUES (?, ?, ?, ?)",
+		record.Shard, record.Key, record.LSN, record.Timestamp.UnixNano())
 	if err != nil {
-		return fmt.Errorf("error marshaling WAL record: %w", err)
+		return false, fmt.Errorf("error recording idempotency key: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+func applyRequest(tx *sql.Tx, request Requester) error {
+	switch request.GetOp() {
+	case WAL_OP_CONFIG:
+		return createShardTable(tx, request.(ShardConfigRequest))
+	case WAL_OP_UPDATE:
+		return updateDataInShard(tx, request)
+	case WAL_OP_DELETE:
+		return deleteDataFromShard(tx, request)
+	case WAL_OP_PREPARE:
+		return prepareInShard(tx, request.(PrepareRequest))
+	case WAL_OP_COMMIT:
+		return commitInShard(tx, request.(CommitRequest))
+	case WAL_OP_ABORT:
+		_, err := deletePreparedTxn(tx, request.GetShard(), request.(AbortRequest).TxID)
+		return err
+	default:
+		return writeDataToShard(tx, request)
 	}
+}
 
-	err = os.MkdirAll(WAL_DIRECTORY_PATH, 0755)
+// prepareInShard sets the operations of a prepared transaction aside until
+// it is resolved.
+func prepareInShard(tx *sql.Tx, request PrepareRequest) error {
+	ops, err := json.Marshal(request.Ops)
 	if err != nil {
-		return fmt.Errorf("error creating WAL directory: %w", err)
+		return err
 	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO prepared_txns (shard, txid, ops) VALUES (?, ?, ?)", request.Shard, request.TxID, string(ops))
+	return err
+}
 
-	walFilePath := filepath.Join(WAL_DIRECTORY_PATH, "wal.txt")
+// commitInShard applies the operations of a prepared transaction. A
+// transaction that is no longer prepared has already been resolved, and is
+// left alone, so that committing twice changes nothing.
+func commitInShard(tx *sql.Tx, request CommitRequest) error {
+	prepared, err := deletePreparedTxn(tx, request.Shard, request.TxID)
+	if err != nil || !prepared {
+		return err
+	}
 
-	walFile, err := os.OpenFile(walFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	requests, err := request.requests()
 	if err != nil {
-		return fmt.Errorf("error opening WAL file: %w", err)
+		return err
 	}
-	defer walFile.Close()
-	newLine := []byte("\n")
-	recordData = append(recordData, newLine...)
-	_, err = walFile.Write(recordData)
-	if err != nil {
-		return fmt.Errorf("error writing to WAL file: %w", err)
+	for _, request := range requests {
+		if err := applyRequest(tx, request); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = walFile.Sync()
+// deletePreparedTxn resolves a prepared transaction and reports whether it
+// was still prepared.
+func deletePreparedTxn(tx *sql.Tx, shard string, txID string) (bool, error) {
+	result, err := tx.Exec("DELETE FROM prepared_txns WHERE shard = ? AND txid = ?", shard, txID)
 	if err != nil {
-		return fmt.Errorf("error flushing WAL file: %w", err)
+		return false, err
 	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
 
+func setAppliedLSN(tx *sql.Tx, shard string, lsn int64) error {
+	_, err := tx.Exec("INSERT INTO wal_applied (shard, lsn) VALUES (?, ?) ON CONFLICT(shard) DO UPDATE SET lsn = excluded.lsn",
+		shard, lsn)
+	if err != nil {
+		return fmt.Errorf("error recording applied LSN: %w", err)
+	}
 	return nil
 }
 
-func (u UpdateRequest) GetShard() string {
-	return u.Shard
+func getAppliedLSN(shard string) (int64, error) {
+	var lsn int64
+	err := db.QueryRow("SELECT lsn FROM wal_applied WHERE shard = ?", shard).Scan(&lsn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying wal_applied: %w", err)
+	}
+	return lsn, nil
 }
 
-func (u UpdateRequest) GetStudID() int {
-	return u.StudID
+// addColumn adds column to a table created by an earlier version of the
+// server, which lacks it.
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading %s table: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, dtype string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &dtype, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("error reading %s table: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading %s table: %w", table, err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding %s to %s table: %w", column, table, err)
+	}
+	return nil
 }
 
-func (u UpdateRequest) GetShardData() []ShardData {
-	return []ShardData{u.Data}
+// setStandalone records whether shard is a standalone copy, which is kept
+// out of the shard's Raft group across restarts.
+func setStandalone(shard string, standalone bool) error {
+	_, err := db.Exec("INSERT INTO wal_applied (shard, lsn, standalone) VALUES (?, 0, ?) ON CONFLICT(shard) DO UPDATE SET standalone = excluded.standalone",
+		shard, standalone)
+	if err != nil {
+		return fmt.Errorf("error recording standalone shard: %w", err)
+	}
+	return nil
 }
 
-func (d DeleteRequest) GetShard() string {
-	return d.Shard
+func isStandalone(shard string) (bool, error) {
+	var standalone bool
+	err := db.QueryRow("SELECT standalone FROM wal_applied WHERE shard = ?", shard).Scan(&standalone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error querying wal_applied: %w", err)
+	}
+	return standalone, nil
 }
 
-func (d DeleteRequest) GetStudID() int {
-	return d.StudID
+// takeSnapshot reads every row of shard together with the LSN they reflect.
+func takeSnapshot(shard string) (Snapshot, error) {
+	unlock := lockShard(shard)
+	defer unlock()
+
+	return readSnapshot(shard)
 }
 
-func (d DeleteRequest) GetShardData() []ShardData {
-	// No data for DeleteRequest
-	return nil
+// readSnapshot is takeSnapshot for callers that already hold the shard lock.
+func readSnapshot(shard string) (Snapshot, error) {
+	lsn, err := getAppliedLSN(shard)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	data, err := fetchDataFromShard(db, fmt.Sprintf("SELECT Stud_id, Stud_name, Stud_marks FROM %s", shard))
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	prepared, err := getPreparedTxns(shard)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	keys, err := getAppliedKeys(shard)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var term int64
+	if shardLog, ok := walManager.Get(shard); ok {
+		term, _ = shardLog.TermAt(lsn)
+	}
+
+	return Snapshot{
+		Shard:     shard,
+		LSN:       lsn,
+		Term:      term,
+		Timestamp: time.Now(),
+		Data:      data,
+		Prepared:  prepared,
+		Keys:      keys,
+	}, nil
 }
-func (w WriteRequest) GetShard() string {
-	return w.Shard
+
+// loadSnapshot replaces the rows of the snapshot's shard and restarts its WAL
+// at the snapshot's LSN, so that the records after it can be caught up.
+func loadSnapshot(snapshot Snapshot) error {
+	unlock := lockShard(snapshot.Shard)
+	defer unlock()
+
+	err := installShard(snapshot.Shard, func() (int64, error) {
+		return replaceShard(snapshot)
+	})
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Timestamp.IsZero() {
+		snapshot.Timestamp = time.Now()
+	}
+	if err := storeSnapshot(snapshot); err != nil {
+		return err
+	}
+	_, err = pruneSnapshots(snapshot.Shard)
+	return err
 }
 
-func (w WriteRequest) GetStudID() int {
-	// No student ID for WriteRequest
-	return 0
+// replaceShard does the work of loadSnapshot. The caller holds the shard's
+// lock, and runs it through installShard.
+func replaceShard(snapshot Snapshot) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", snapshot.Shard))
+	if err != nil {
+		return 0, err
+	}
+	if err := writeDataToShard(tx, WriteRequest{Shard: snapshot.Shard, Data: snapshot.Data}); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM prepared_txns WHERE shard = ?", snapshot.Shard)
+	if err != nil {
+		return 0, err
+	}
+	for _, prepared := range snapshot.Prepared {
+		err := prepareInShard(tx, PrepareRequest{Shard: snapshot.Shard, TxID: prepared.TxID, Ops: prepared.Ops})
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM idempotency_keys WHERE shard = ?", snapshot.Shard)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range snapshot.Keys {
+		_, err := claimKey(tx, wal.Record{Shard: snapshot.Shard, Key: key.Key, LSN: key.LSN, Timestamp: key.Timestamp})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := setAppliedLSN(tx, snapshot.Shard, snapshot.LSN); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	shardLog, err := walManager.Log(snapshot.Shard)
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.LSN, shardLog.Reset(snapshot.LSN, snapshot.Term)
 }
 
-func (w WriteRequest) GetShardData() []ShardData {
-	return w.Data
+func snapshotPath(shard string, lsn int64, timestamp time.Time) string {
+	return filepath.Join(SNAPSHOT_DIRECTORY_PATH, shard, fmt.Sprintf("%020d-%d.json", lsn, timestamp.UnixNano()))
 }
-func replicateToSecondaries(payload Requester, reqMethod string, route string, secondaryServers []int) ([]bool, error) {
 
-	acks := make([]bool, len(secondaryServers))
-	var err error
+// listStoredSnapshots returns the snapshots stored for shard in LSN order.
+func listStoredSnapshots(shard string) ([]storedSnapshot, error) {
+	entries, err := os.ReadDir(filepath.Join(SNAPSHOT_DIRECTORY_PATH, shard))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot directory: %w", err)
+	}
 
-	for i, serverID := range secondaryServers {
-		payloadData, err := json.Marshal(payload)
-		if err != nil {
-			acks[i] = false
+	stored := []storedSnapshot{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
 			continue
 		}
-
-		req, err := http.NewRequest(reqMethod, fmt.Sprintf("http://Server%d:5000%s", serverID, route), bytes.NewBuffer(payloadData))
+		parts := strings.SplitN(strings.TrimSuffix(name, ".json"), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lsn, err := strconv.ParseInt(parts[0], 10, 64)
 		if err != nil {
-			log.Println("Error sending request to Server:", err)
-			acks[i] = false
+			continue
 		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
 		if err != nil {
-			acks[i] = false
+			continue
 		}
-		resp.Body.Close()
+		stored = append(stored, storedSnapshot{
+			lsn:       lsn,
+			timestamp: time.Unix(0, nanos),
+			path:      filepath.Join(SNAPSHOT_DIRECTORY_PATH, shard, name),
+		})
 	}
-	return acks, err
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].lsn < stored[j].lsn
+	})
+
+	return stored, nil
 }
 
-func receivedMajorityAck(acks []bool) bool {
+// storeSnapshot durably writes snapshot to the snapshot directory of its
+// shard and archives it along with the WAL.
+func storeSnapshot(snapshot Snapshot) error {
+	path := snapshotPath(snapshot.Shard, snapshot.LSN, snapshot.Timestamp)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating snapshot directory: %w", err)
+	}
 
-	finalAck := true
-	for _, ack := range acks {
-		if !ack {
-			finalAck = false
-			break
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot file: %w", err)
+	}
+	if err := json.NewEncoder(file).Encode(snapshot); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing snapshot file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing snapshot file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	if archiver != nil {
+		err := archiver.Archive(snapshot.Shard, filepath.Join("snapshots", filepath.Base(path)), path)
+		if err != nil {
+			log.Printf("Error archiving snapshot %s: %v\n", path, err)
 		}
 	}
-	return finalAck
+	return nil
 }
 
-func isPrimary(primary int) bool {
+func readStoredSnapshot(path string) (Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("error opening snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(file).Decode(&snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("error decoding snapshot file %s: %w", path, err)
+	}
+	return snapshot, nil
+}
 
-	serverID := os.Getenv("id")
-	serverIDInt, err := strconv.Atoi(serverID)
+// pruneSnapshots deletes the oldest snapshots of shard beyond the retention
+// and returns the LSN of the oldest one kept. The WAL up to that LSN is not
+// needed for point-in-time recovery anymore.
+func pruneSnapshots(shard string) (int64, error) {
+	stored, err := listStoredSnapshots(shard)
 	if err != nil {
-		return false
+		return 0, err
+	}
+
+	retention := getEnvInt("SNAPSHOT_RETENTION", SNAPSHOT_RETENTION)
+	for retention > 0 && len(stored) > retention {
+		if err := os.Remove(stored[0].path); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("error removing snapshot file: %w", err)
+		}
+		stored = stored[1:]
 	}
 
-	return serverIDInt == primary
+	if len(stored) == 0 {
+		return 0, nil
+	}
+	return stored[0].lsn, nil
 }
 
-func lineCounter(r io.Reader) (int, error) {
-	buf := make([]byte, 32*1024)
-	count := 0
-	lineSep := []byte{'\n'}
+// errReplayTarget stops a point-in-time replay once it passes its target.
+var errReplayTarget = errors.New("replay target reached")
 
-	for {
-		c, err := r.Read(buf)
-		count += bytes.Count(buf[:c], lineSep)
+// restorePointInTime rebuilds the rows of shard as of targetLSN, or as of
+// targetTime when targetLSN is 0. It starts from the newest stored snapshot
+// before that point and replays the WAL records after it, without touching
+// the shard table.
+func restorePointInTime(shard string, targetLSN int64, targetTime time.Time) (Snapshot, error) {
+	shardLog, ok := walManager.Get(shard)
+	if !ok {
+		return Snapshot{}, fmt.Errorf("no WAL for shard %s", shard)
+	}
+	if targetLSN > shardLog.LastLSN() {
+		return Snapshot{}, fmt.Errorf("LSN %d is ahead of the WAL of shard %s at %d", targetLSN, shard, shardLog.LastLSN())
+	}
+
+	stored, err := listStoredSnapshots(shard)
+	if err != nil {
+		return Snapshot{}, err
+	}
 
-		switch {
-		case err == io.EOF:
-			return count, nil
+	base := Snapshot{Shard: shard}
+	for i := len(stored) - 1; i >= 0; i-- {
+		if (targetLSN > 0 && stored[i].lsn <= targetLSN) || (targetLSN == 0 && !stored[i].timestamp.After(targetTime)) {
+			base, err = readStoredSnapshot(stored[i].path)
+			if err != nil {
+				return Snapshot{}, err
+			}
+			break
+		}
+	}
+
+	rows := make(map[int]ShardData)
+	for _, row := range base.Data {
+		rows[row.StudentID] = row
+	}
+	keys := make(map[string]bool)
+	for _, key := range base.Keys {
+		keys[key.Key] = true
+	}
+
+	point := Snapshot{
+		Shard:     shard,
+		LSN:       base.LSN,
+		Timestamp: base.Timestamp,
+	}
+	err = shardLog.ReadFrom(base.LSN+1, func(record wal.Record) error {
+		if (targetLSN > 0 && record.LSN > targetLSN) || (targetLSN == 0 && record.Timestamp.After(targetTime)) {
+			return errReplayTarget
+		}
+		if record.Op == raft.OP_NOOP {
+			return nil
+		}
 
-		case err != nil:
-			return count, err
+		requests, err := rowRequestsFromRecord(record)
+		if err != nil {
+			return err
+		}
+		if record.Key != "" && recordsKey(record.Op) {
+			if keys[record.Key] {
+				requests = nil
+			}
+			keys[record.Key] = true
+		}
+		for _, request := range requests {
+			switch request.GetOp() {
+			case WAL_OP_WRITE:
+				for _, row := range request.GetShardData() {
+					rows[row.StudentID] = row
+				}
+			case WAL_OP_UPDATE:
+				row, ok := rows[request.GetStudID()]
+				if ok && len(request.GetShardData()) != 0 {
+					row.StudentMarks = request.GetShardData()[0].StudentMarks
+					rows[request.GetStudID()] = row
+				}
+			case WAL_OP_DELETE:
+				delete(rows, request.GetStudID())
+			}
 		}
+
+		point.LSN = record.LSN
+		point.Timestamp = record.Timestamp
+		return nil
+	})
+	if errors.Is(err, wal.ErrNotRetained) {
+		return Snapshot{}, fmt.Errorf("WAL of shard %s after LSN %d is no longer retained", shard, base.LSN)
+	}
+	if err != nil && !errors.Is(err, errReplayTarget) {
+		return Snapshot{}, err
+	}
+
+	point.Data = make([]ShardData, 0, len(rows))
+	for _, row := range rows {
+		point.Data = append(point.Data, row)
 	}
+	sort.Slice(point.Data, func(i, j int) bool {
+		return point.Data[i].StudentID < point.Data[j].StudentID
+	})
+
+	return point, nil
 }
 
-func getWalLength() int {
+func getShardSchema(shard string) (schema, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", shard))
+	if err != nil {
+		return schema{}, err
+	}
+	defer rows.Close()
 
-	walFilePath := filepath.Join(WAL_DIRECTORY_PATH, "wal.txt")
-	file, err := os.Open(walFilePath)
-	if os.IsNotExist(err) {
-		return 0
+	var shardSchema schema
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, dtype string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &dtype, &notNull, &defaultValue, &pk); err != nil {
+			return schema{}, err
+		}
+		shardSchema.Columns = append(shardSchema.Columns, name)
+		shardSchema.Dtypes = append(shardSchema.Dtypes, dtype)
 	}
-	defer file.Close()
-	lines, err := lineCounter(file)
-	if err != nil {
-		log.Println("Error while fetching wal file length: " + err.Error())
-		return -1
+	if len(shardSchema.Columns) == 0 {
+		return schema{}, fmt.Errorf("shard %s has no table", shard)
 	}
-	return lines
+	return shardSchema, rows.Err()
 }
 
-func synReplication(shard string, reqBody Requester, reqMethod string, route string, w http.ResponseWriter) {
-	payload := ShardServersRequest{
-		ShardID: shard,
+// restoreShard restores a shard as of the requested point into a new shard
+// on this server, where it can be inspected without affecting the original.
+func restoreShard(request RestoreRequest) (Snapshot, error) {
+	if request.TargetShard == "" || request.TargetShard == request.Shard {
+		return Snapshot{}, fmt.Errorf("target shard must be a new shard")
+	}
+	if _, ok := walManager.Get(request.TargetShard); ok {
+		return Snapshot{}, fmt.Errorf("shard %s already exists", request.TargetShard)
 	}
 
-	payloadData, err := json.Marshal(payload)
+	point, err := restorePointInTime(request.Shard, request.LSN, request.Timestamp)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
-		return
+		return Snapshot{}, err
 	}
 
-	req, err := http.NewRequest("GET", SHARD_MANAGER_URL+"/shard_servers", bytes.NewBuffer(payloadData))
+	shardSchema, err := getShardSchema(request.Shard)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating request for shard manager: %v", err), http.StatusInternalServerError)
-		return
+		return Snapshot{}, err
 	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = configureShard(ShardConfigRequest{Shard: request.TargetShard, Schema: shardSchema})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error sending request to shard manager: %v", err), http.StatusInternalServerError)
-		return
+		return Snapshot{}, err
+	}
+	if err := startRaftNode(request.TargetShard); err != nil {
+		return Snapshot{}, err
+	}
+	shardLog, err := walManager.Log(request.TargetShard)
+	if err != nil {
+		return Snapshot{}, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	unlock := lockShard(request.TargetShard)
+	defer unlock()
+
+	// The rows are loaded into the new shard as a snapshot taken after its
+	// last record, through its Raft node, so that its replicas load the same
+	// snapshot from it instead of replaying a log that lacks the rows.
+	restored := Snapshot{
+		Shard:     request.TargetShard,
+		Timestamp: time.Now(),
+		Data:      point.Data,
+	}
+	err = installShard(request.TargetShard, func() (int64, error) {
+		lsn, term := shardLog.Last()
+		restored.LSN = lsn + 1
+		restored.Term = term
+		return replaceShard(restored)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading response body: %v", err), http.StatusInternalServerError)
-		return
+		return Snapshot{}, err
+	}
+	if err := storeSnapshot(restored); err != nil {
+		return Snapshot{}, err
+	}
+	if _, err := pruneSnapshots(restored.Shard); err != nil {
+		return Snapshot{}, err
 	}
 
-	var shardServers ShardServersResponse
-	err = json.Unmarshal(body, &shardServers)
+	return point, nil
+}
+
+func lockShard(shard string) func() {
+	mutex, _ := shardLocks.LoadOrStore(shard, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+// writeToWAL appends the request to its shard's WAL outside of Raft and
+// returns the record it was logged as. It is only meant for records every
+// replica logs on its own, such as the creation of a shard.
+func writeToWAL(req Requester) (wal.Record, error) {
+	payload, err := json.Marshal(req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error unmarshaling JSON: %v", err), http.StatusInternalServerError)
-		return
+		return wal.Record{}, fmt.Errorf("error marshaling WAL payload: %w", err)
 	}
 
-	if err := writeToWAL(reqBody); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing to WAL: %v", err), http.StatusInternalServerError)
-		return
+	shardLog, err := walManager.Log(req.GetShard())
+	if err != nil {
+		return wal.Record{}, err
 	}
 
-	if isPrimary(shardServers.Primary) {
+	return shardLog.Append(0, req.GetOp(), "", payload)
+}
 
-		var secondaries []int
-		for _, server := range shardServers.ServerIDs {
-			if server != shardServers.Primary {
-				secondaries = append(secondaries, server)
+// requestFromRecord rebuilds the request that produced a WAL record from its
+// payload.
+func requestFromRecord(record wal.Record) (Requester, error) {
+	var request Requester
+	var err error
+
+	switch record.Op {
+	case WAL_OP_CONFIG:
+		var req ShardConfigRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_WRITE:
+		var req WriteRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_UPDATE:
+		var req UpdateRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_DELETE:
+		var req DeleteRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_PREPARE:
+		var req PrepareRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_COMMIT:
+		var req CommitRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	case WAL_OP_ABORT:
+		var req AbortRequest
+		err = json.Unmarshal(record.Payload, &req)
+		request = req
+	default:
+		return nil, fmt.Errorf("unknown WAL op %q", record.Op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s payload: %w", record.Op, err)
+	}
+
+	return request, nil
+}
+
+// rowRequestsFromRecord returns the writes, updates and deletes a WAL record
+// makes to the rows of its shard: the request itself, the operations of the
+// transaction it commits, or none for the other records.
+func rowRequestsFromRecord(record wal.Record) ([]Requester, error) {
+	switch record.Op {
+	case WAL_OP_CONFIG, WAL_OP_PREPARE, WAL_OP_ABORT, raft.OP_NOOP:
+		return nil, nil
+	}
+
+	request, err := requestFromRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	if commit, ok := request.(CommitRequest); ok {
+		return commit.requests()
+	}
+	return []Requester{request}, nil
+}
+
+// fetchRow returns the row of shard with studID, or nil if there is none.
+func fetchRow(shard string, studID int) (*ShardData, error) {
+	var row ShardData
+	query := fmt.Sprintf("SELECT Stud_id, Stud_name, Stud_marks FROM %s WHERE Stud_id = ?", shard)
+	err := db.QueryRow(query, studID).Scan(&row.StudentID, &row.StudentName, &row.StudentMarks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// changeEvents turns a WAL record into the row changes it makes. Writes have
+// no before value, and neither do updates and deletes logged before their
+// records carried one.
+func changeEvents(record wal.Record) ([]ChangeEvent, error) {
+	requests, err := rowRequestsFromRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []ChangeEvent{}
+	for _, request := range requests {
+		event := ChangeEvent{
+			Shard:     record.Shard,
+			Position:  record.LSN,
+			Timestamp: record.Timestamp,
+			Op:        request.GetOp(),
+		}
+
+		switch req := request.(type) {
+		case WriteRequest:
+			for _, row := range req.Data {
+				after := row
+				event.StudID = row.StudentID
+				event.After = &after
+				events = append(events, event)
+			}
+		case UpdateRequest:
+			after := ShardData{
+				StudentID:    req.StudID,
+				StudentName:  req.Data.StudentName,
+				StudentMarks: req.Data.StudentMarks,
+			}
+			if req.Before != nil {
+				after.StudentName = req.Before.StudentName
+			}
+			event.StudID = req.StudID
+			event.Before = req.Before
+			event.After = &after
+			events = append(events, event)
+		case DeleteRequest:
+			event.StudID = req.StudID
+			event.Before = req.Before
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func getAppliedLSNs(db *sql.DB) (map[string]int64, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS wal_applied (shard TEXT PRIMARY KEY, lsn INTEGER NOT NULL, standalone INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		return nil, fmt.Errorf("error creating wal_applied table: %w", err)
+	}
+	if err := addColumn(db, "wal_applied", "standalone", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT shard, lsn FROM wal_applied")
+	if err != nil {
+		return nil, fmt.Errorf("error querying wal_applied: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[string]int64)
+	for rows.Next() {
+		var shard string
+		var lsn int64
+		if err := rows.Scan(&shard, &lsn); err != nil {
+			return nil, fmt.Errorf("error scanning wal_applied: %w", err)
+		}
+		applied[shard] = lsn
+	}
+
+	return applied, rows.Err()
+}
+
+// recoverFromWAL brings every shard table up to date with its WAL before the
+// server starts serving. It repairs the WAL of shards whose snapshot load was
+// interrupted, then applies the records after the LSN each table reflects up
+// to the commit LSN its Raft node saved, so that a restarted replica serves
+// what it had without waiting for a leader. A shard's recovery stops at the
+// first record that fails to apply, which its Raft node then retries, or
+// halts at if it is malformed; see applyCommittedRecord.
+func recoverFromWAL(db *sql.DB) error {
+	applied, err := getAppliedLSNs(db)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range walManager.Shards() {
+		shardLog, err := walManager.Log(shard)
+		if err != nil {
+			return err
+		}
+
+		// A snapshot was loaded but the server stopped before its WAL was
+		// restarted at the snapshot's LSN.
+		if applied[shard] > shardLog.LastLSN() {
+			log.Printf("Restarting WAL of shard %s at snapshot LSN %d\n", shard, applied[shard])
+			if err := shardLog.Reset(applied[shard], 0); err != nil {
+				return err
+			}
+		}
+
+		commit, err := raftStore.LoadCommit(shard)
+		if err != nil {
+			return err
+		}
+		recovered := applied[shard]
+		if commit > recovered {
+			errRecovered := errors.New("recovered")
+			err := shardLog.ReadFrom(recovered+1, func(record wal.Record) error {
+				if record.LSN > commit {
+					return errRecovered
+				}
+				if err := applyCommittedRecord(record); err != nil {
+					return err
+				}
+				recovered = record.LSN
+				return nil
+			})
+			if err != nil && !errors.Is(err, errRecovered) {
+				log.Printf("WAL recovery of shard %s stops at LSN %d: %v\n", shard, recovered+1, err)
+			}
+		}
+
+		log.Printf("WAL recovery of shard %s complete: applied LSN %d, commit LSN %d, last LSN %d\n", shard, recovered, commit, shardLog.LastLSN())
+	}
+
+	return nil
+}
+
+// checkpointShard checkpoints the shard's WAL at the last LSN committed to
+// its table and stores a snapshot of the table at that LSN. The WAL drops the
+// segments before the oldest snapshot kept, so that point-in-time recovery
+// can replay from any of them.
+func checkpointShard(shard string) (int64, error) {
+	unlock := lockShard(shard)
+	defer unlock()
+
+	shardLog, err := walManager.Log(shard)
+	if err != nil {
+		return 0, err
+	}
+
+	lsn, err := getAppliedLSN(shard)
+	if err != nil {
+		return 0, err
+	}
+
+	stored, err := listStoredSnapshots(shard)
+	if err != nil {
+		return 0, err
+	}
+	if lsn > 0 && (len(stored) == 0 || stored[len(stored)-1].lsn < lsn) {
+		snapshot, err := readSnapshot(shard)
+		if err != nil {
+			return 0, err
+		}
+		if err := storeSnapshot(snapshot); err != nil {
+			return 0, err
+		}
+	}
+	retainLSN, err := pruneSnapshots(shard)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := shardLog.Checkpoint(lsn); err != nil {
+		return 0, err
+	}
+	if err := shardLog.Truncate(retainLSN); err != nil {
+		return 0, err
+	}
+	return shardLog.CheckpointLSN(), nil
+}
+
+func checkpointPeriodically() {
+	for {
+		time.Sleep(WAL_CHECKPOINT_INTERVAL)
+		for _, shard := range walManager.Shards() {
+			if _, err := checkpointShard(shard); err != nil {
+				log.Printf("Error checkpointing WAL of shard %s: %v\n", shard, err)
+			}
+		}
+		if err := expireIdempotencyKeys(); err != nil {
+			log.Printf("Error expiring idempotency keys: %v\n", err)
+		}
+	}
+}
+
+// applyReplicatedRecord logs a committed record received from another
+// replica under its original LSN and term and applies it to the shard table.
+func applyReplicatedRecord(record wal.Record) error {
+	shardLog, err := walManager.Log(record.Shard)
+	if err != nil {
+		return err
+	}
+	if record.LSN <= shardLog.LastLSN() {
+		return nil
+	}
+
+	return installShard(record.Shard, func() (int64, error) {
+		if record.Op == raft.OP_NOOP {
+			if err := shardLog.AppendRecord(record); err != nil {
+				return 0, err
+			}
+			return record.LSN, markApplied(record.Shard, record.LSN)
+		}
+
+		request, err := requestFromRecord(record)
+		if err != nil {
+			return 0, err
+		}
+		if err := shardLog.AppendRecord(record); err != nil {
+			return 0, err
+		}
+		return record.LSN, applyToShard(db, request, record)
+	})
+}
+
+// catchUpShard fetches the committed records of shard that this server is
+// missing from the WAL of another replica and applies them in order.
+func catchUpShard(shard string, sourceServerID int) (int, error) {
+	unlock := lockShard(shard)
+	defer unlock()
+
+	shardLog, err := walManager.Log(shard)
+	if err != nil {
+		return 0, err
+	}
+
+	url := fmt.Sprintf("http://Server%d:5000/wal_stream?shard=%s&from=%d", sourceServerID, shard, shardLog.LastLSN()+1)
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("error streaming WAL from Server%d: %v", sourceServerID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("error streaming WAL from Server%d: %s", sourceServerID, strings.TrimSpace(string(body)))
+	}
+
+	records := 0
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var record wal.Record
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return records, fmt.Errorf("error decoding WAL stream: %v", err)
+		}
+
+		if err := applyReplicatedRecord(record); err != nil {
+			return records, fmt.Errorf("error applying WAL record %s:%d: %v", shard, record.LSN, err)
+		}
+		records++
+	}
+
+	return records, nil
+}
+
+// readShardRange reads the rows of shard with a Stud_id between low and high
+// together with the LSN they reflect, in one read transaction so that both
+// agree.
+func readShardRange(shard string, low int, high int) (Snapshot, error) {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer tx.Rollback()
+
+	var lsn int64
+	err = tx.QueryRow("SELECT lsn FROM wal_applied WHERE shard = ?", shard).Scan(&lsn)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Snapshot{}, fmt.Errorf("error querying wal_applied: %w", err)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT Stud_id, Stud_name, Stud_marks FROM %s WHERE Stud_id BETWEEN ? AND ? ORDER BY Stud_id", shard), low, high)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer rows.Close()
+
+	data := []ShardData{}
+	for rows.Next() {
+		var row ShardData
+		if err := rows.Scan(&row.StudentID, &row.StudentName, &row.StudentMarks); err != nil {
+			return Snapshot{}, err
+		}
+		data = append(data, row)
+	}
+	if err := rows.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	return Snapshot{
+		Shard:     shard,
+		LSN:       lsn,
+		Timestamp: time.Now(),
+		Data:      data,
+	}, nil
+}
+
+// buildMerkleTree returns the Merkle tree of every row of shard.
+func buildMerkleTree(shard string) (MerkleTree, error) {
+	snapshot, err := readShardRange(shard, math.MinInt, math.MaxInt)
+	if err != nil {
+		return MerkleTree{}, err
+	}
+
+	entries := make([]merkle.Entry, 0, len(snapshot.Data))
+	for _, row := range snapshot.Data {
+		entries = append(entries, merkle.Entry{
+			ID:   row.StudentID,
+			Data: []byte(fmt.Sprintf("%d|%s|%d", row.StudentID, row.StudentName, row.StudentMarks)),
+		})
+	}
+
+	width := getEnvInt("ANTI_ENTROPY_BUCKET_WIDTH", ANTI_ENTROPY_BUCKET_WIDTH)
+	if width <= 0 {
+		width = ANTI_ENTROPY_BUCKET_WIDTH
+	}
+	return MerkleTree{
+		Shard: shard,
+		LSN:   snapshot.LSN,
+		Tree:  merkle.Build(width, entries),
+	}, nil
+}
+
+// fetchFromReplica GETs route from another replica and decodes its answer
+// into response.
+func fetchFromReplica(serverID int, route string, response interface{}) error {
+	resp, err := http.Get(fmt.Sprintf("http://Server%d:5000%s", serverID, route))
+	if err != nil {
+		return fmt.Errorf("error querying Server%d: %v", serverID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error querying Server%d: %s", serverID, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// waitApplied waits until the shard reflects the WAL up to lsn, and reports
+// whether it did before timeout.
+func waitApplied(node *raft.Node, lsn int64, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		applied, changed := node.Applied()
+		if applied >= lsn {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// errAntiEntropyBusy ends an anti-entropy attempt in which this replica and
+// the leader were not at the same LSN.
+var errAntiEntropyBusy = errors.New("replica and leader are at different LSNs")
+
+// antiEntropyRound compares the Merkle tree of a shard this server follows
+// with the leader's, at the same LSN, and replaces the rows of every Stud_id
+// range that differs with the leader's. It returns how many ranges differed.
+func antiEntropyRound(shard string) (int, error) {
+	node, ok := getRaftNode(shard)
+	if !ok {
+		return 0, fmt.Errorf("no Raft node for shard %s", shard)
+	}
+	status := node.Status()
+	if status.Role == raft.ROLE_LEADER || status.Leader == raft.NONE {
+		return 0, nil
+	}
+
+	timeout := getEnvDuration("REPLICATION_TIMEOUT", REPLICATION_TIMEOUT)
+	for attempt := 0; attempt < getEnvInt("ANTI_ENTROPY_ATTEMPTS", ANTI_ENTROPY_ATTEMPTS); attempt++ {
+		var remote MerkleTree
+		if err := fetchFromReplica(status.Leader, "/merkle?shard="+url.QueryEscape(shard), &remote); err != nil {
+			return 0, err
+		}
+		waitApplied(node, remote.LSN, timeout)
+
+		local, err := buildMerkleTree(shard)
+		if err != nil {
+			return 0, err
+		}
+		if local.LSN != remote.LSN {
+			continue
+		}
+
+		ranges, err := merkle.Diff(local.Tree, remote.Tree)
+		if err != nil {
+			return 0, err
+		}
+		antiEntropy.found(shard, local.LSN, len(ranges))
+		if len(ranges) != 0 {
+			log.Printf("Shard %s differs from Server%d in %d Stud_id ranges at LSN %d\n", shard, status.Leader, len(ranges), local.LSN)
+		}
+
+		for _, r := range ranges {
+			rows, err := repairRange(shard, node, status.Leader, r)
+			if err != nil {
+				return len(ranges), fmt.Errorf("error repairing Stud_id %d-%d: %w", r.Low, r.High, err)
 			}
+			antiEntropy.repaired(shard, rows)
+		}
+		return len(ranges), nil
+	}
+	return 0, errAntiEntropyBusy
+}
+
+// repairRange replaces the rows of shard in a Stud_id range with the leader's.
+// The leader's rows are only taken if this replica is at the LSN they were
+// read at, so that no write is undone or applied twice. The repaired rows are
+// not in the WAL, so the shard is then checkpointed past them, and recovery
+// and point-in-time restores start from a snapshot that has them.
+func repairRange(shard string, node *raft.Node, leader int, r merkle.Range) (int, error) {
+	timeout := getEnvDuration("REPLICATION_TIMEOUT", REPLICATION_TIMEOUT)
+	for attempt := 0; attempt < getEnvInt("ANTI_ENTROPY_ATTEMPTS", ANTI_ENTROPY_ATTEMPTS); attempt++ {
+		var remote Snapshot
+		route := fmt.Sprintf("/merkle_range?shard=%s&low=%d&high=%d", url.QueryEscape(shard), r.Low, r.High)
+		if err := fetchFromReplica(leader, route, &remote); err != nil {
+			return 0, err
 		}
+		waitApplied(node, remote.LSN, timeout)
+
+		unlock := lockShard(shard)
+		err := installShard(shard, func() (int64, error) {
+			applied, err := getAppliedLSN(shard)
+			if err != nil {
+				return 0, err
+			}
+			if applied != remote.LSN {
+				return applied, errAntiEntropyBusy
+			}
 
-		acks, err := replicateToSecondaries(reqBody, reqMethod, route, secondaries)
+			tx, err := db.Begin()
+			if err != nil {
+				return 0, err
+			}
+			defer tx.Rollback()
+
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE Stud_id BETWEEN ? AND ?", shard), r.Low, r.High)
+			if err != nil {
+				return 0, err
+			}
+			if err := writeDataToShard(tx, WriteRequest{Shard: shard, Data: remote.Data}); err != nil {
+				return 0, err
+			}
+			if err := tx.Commit(); err != nil {
+				return 0, err
+			}
+			return applied, checkpointRepair(shard, applied)
+		})
+		unlock()
+		if errors.Is(err, errAntiEntropyBusy) {
+			continue
+		}
 		if err != nil {
-			http.Error(w, "Error replicating to secondaries", http.StatusInternalServerError)
-			return
+			return 0, err
 		}
+		return len(remote.Data), nil
+	}
+	return 0, errAntiEntropyBusy
+}
+
+// checkpointRepair stores a snapshot of shard as repaired at lsn and
+// checkpoints its WAL there. The caller holds the shard's lock.
+func checkpointRepair(shard string, lsn int64) error {
+	snapshot, err := readSnapshot(shard)
+	if err != nil {
+		return err
+	}
+	if err := storeSnapshot(snapshot); err != nil {
+		return err
+	}
+	if _, err := pruneSnapshots(shard); err != nil {
+		return err
+	}
+
+	shardLog, err := walManager.Log(shard)
+	if err != nil {
+		return err
+	}
+	return shardLog.Checkpoint(lsn)
+}
 
-		if !receivedMajorityAck(acks) {
-			http.Error(w, "Did not receive majority acknowledgments", http.StatusInternalServerError)
-			return
+func antiEntropyPeriodically() {
+	for {
+		time.Sleep(getEnvDuration("ANTI_ENTROPY_INTERVAL", ANTI_ENTROPY_INTERVAL))
+		for _, shard := range walManager.Shards() {
+			if _, err := antiEntropyRound(shard); err != nil {
+				antiEntropy.failed(shard, err)
+				log.Printf("Error running anti-entropy on shard %s: %v\n", shard, err)
+			}
 		}
 	}
 }
+
+func newAntiEntropyTracker() *antiEntropyTracker {
+	return &antiEntropyTracker{
+		stats: make(map[string]*AntiEntropyStats),
+	}
+}
+
+func (t *antiEntropyTracker) get(shard string) *AntiEntropyStats {
+	if t.stats[shard] == nil {
+		t.stats[shard] = &AntiEntropyStats{}
+	}
+	return t.stats[shard]
+}
+
+// found records a comparison with the leader at lsn and how many ranges
+// differed in it.
+func (t *antiEntropyTracker) found(shard string, lsn int64, ranges int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := t.get(shard)
+	stats.Rounds++
+	stats.LastRound = time.Now()
+	stats.LastLSN = lsn
+	stats.DivergentRanges = ranges
+	stats.TotalDivergentRanges += ranges
+	stats.LastError = ""
+}
+
+func (t *antiEntropyTracker) repaired(shard string, rows int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := t.get(shard)
+	stats.RepairedRanges++
+	stats.RepairedRows += rows
+}
+
+func (t *antiEntropyTracker) failed(shard string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.get(shard).LastError = err.Error()
+}
+
+// snapshot returns a copy of the stats of every shard.
+func (t *antiEntropyTracker) snapshot() map[string]AntiEntropyStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := make(map[string]AntiEntropyStats)
+	for shard, s := range t.stats {
+		stats[shard] = *s
+	}
+	return stats
+}
+
+func (c ShardConfigRequest) GetOp() string {
+	return WAL_OP_CONFIG
+}
+
+func (c ShardConfigRequest) GetShard() string {
+	return c.Shard
+}
+
+func (c ShardConfigRequest) GetStudID() int {
+	// No student ID for ShardConfigRequest
+	return 0
+}
+
+func (c ShardConfigRequest) GetShardData() []ShardData {
+	// No data for ShardConfigRequest
+	return nil
+}
+
+func (u UpdateRequest) GetOp() string {
+	return WAL_OP_UPDATE
+}
+
+func (u UpdateRequest) GetShard() string {
+	return u.Shard
+}
+
+func (u UpdateRequest) GetStudID() int {
+	return u.StudID
+}
+
+func (u UpdateRequest) GetShardData() []ShardData {
+	return []ShardData{u.Data}
+}
+
+func (d DeleteRequest) GetOp() string {
+	return WAL_OP_DELETE
+}
+
+func (d DeleteRequest) GetShard() string {
+	return d.Shard
+}
+
+func (d DeleteRequest) GetStudID() int {
+	return d.StudID
+}
+
+func (d DeleteRequest) GetShardData() []ShardData {
+	// No data for DeleteRequest
+	return nil
+}
+
+func (w WriteRequest) GetOp() string {
+	return WAL_OP_WRITE
+}
+
+func (w WriteRequest) GetShard() string {
+	return w.Shard
+}
+
+func (w WriteRequest) GetStudID() int {
+	// No student ID for WriteRequest
+	return 0
+}
+
+func (w WriteRequest) GetShardData() []ShardData {
+	return w.Data
+}
+
+func (p PrepareRequest) GetOp() string {
+	return WAL_OP_PREPARE
+}
+
+func (p PrepareRequest) GetShard() string {
+	return p.Shard
+}
+
+func (p PrepareRequest) GetStudID() int {
+	// No student ID for PrepareRequest
+	return 0
+}
+
+func (p PrepareRequest) GetShardData() []ShardData {
+	// No data for PrepareRequest
+	return nil
+}
+
+func (c CommitRequest) GetOp() string {
+	return WAL_OP_COMMIT
+}
+
+func (c CommitRequest) GetShard() string {
+	return c.Shard
+}
+
+func (c CommitRequest) GetStudID() int {
+	// No student ID for CommitRequest
+	return 0
+}
+
+func (c CommitRequest) GetShardData() []ShardData {
+	// No data for CommitRequest
+	return nil
+}
+
+// requests returns the operations of the committed transaction as the
+// requests that make them.
+func (c CommitRequest) requests() ([]Requester, error) {
+	requests := make([]Requester, 0, len(c.Ops))
+	for _, op := range c.Ops {
+		request, err := txnOpRequest(c.Shard, op)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+func (a AbortRequest) GetOp() string {
+	return WAL_OP_ABORT
+}
+
+func (a AbortRequest) GetShard() string {
+	return a.Shard
+}
+
+func (a AbortRequest) GetStudID() int {
+	// No student ID for AbortRequest
+	return 0
+}
+
+func (a AbortRequest) GetShardData() []ShardData {
+	// No data for AbortRequest
+	return nil
+}
+
+// replicationQuorum returns how many of a shard's replicas, the leader
+// included, must have a write before a sync or semi-sync write succeeds. Sync
+// shards wait for every replica. Semi-sync shards, and shards without a mode,
+// wait for a majority, which REPLICATION_QUORUM overrides up to the number of
+// replicas; a write is never applied before a majority has it, whatever the
+// quorum. Async writes wait for nothing; see synReplication.
+func replicationQuorum(mode string, replicas int) int {
+	if mode == REPLICATION_MODE_SYNC {
+		return replicas
+	}
+
+	quorum := getEnvInt("REPLICATION_QUORUM", REPLICATION_QUORUM)
+	if quorum <= 0 {
+		return replicas/2 + 1
+	}
+	if quorum > replicas {
+		return replicas
+	}
+	return quorum
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v\n", key, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d\n", key, value, fallback)
+		return fallback
+	}
+	return number
+}
+
+// newArchiver returns the WAL archiver configured through WAL_ARCHIVE_URL or
+// WAL_ARCHIVE_DIR, or nil if archiving is disabled. Every server archives
+// under its own name, so that servers can share one archive.
+func newArchiver() wal.Archiver {
+	prefix := fmt.Sprintf("Server%s", os.Getenv("id"))
+	if url := os.Getenv("WAL_ARCHIVE_URL"); url != "" {
+		return wal.NewHTTPArchiver(strings.TrimSuffix(url, "/") + "/" + prefix)
+	}
+	if dir := os.Getenv("WAL_ARCHIVE_DIR"); dir != "" {
+		return wal.NewDirArchiver(filepath.Join(dir, prefix))
+	}
+	return nil
+}
+
+// requestEpoch returns the fencing token of a client mutation, or 0 if it
+// has none.
+func requestEpoch(r *http.Request) (int64, error) {
+	value := r.Header.Get(EPOCH_HEADER)
+	if value == "" {
+		return 0, nil
+	}
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", EPOCH_HEADER, value)
+	}
+	return epoch, nil
+}
+
+// requestKey returns the idempotency key of a mutation, "" if none.
+func requestKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if len(key) > MAX_IDEMPOTENCY_KEY_LENGTH {
+		return "", fmt.Errorf("%s is longer than %d bytes", IDEMPOTENCY_KEY_HEADER, MAX_IDEMPOTENCY_KEY_LENGTH)
+	}
+	return key, nil
+}
+
+// replicationLag returns the lag of every follower of a shard this server
+// leads.
+func replicationLag(shard string, node *raft.Node) map[int]ReplicaLag {
+	shardLog, ok := walManager.Get(shard)
+	if !ok {
+		return nil
+	}
+	lastLSN := shardLog.LastLSN()
+
+	lag := make(map[int]ReplicaLag)
+	for serverID, progress := range node.Progress() {
+		replicaLag := ReplicaLag{Progress: progress}
+		if progress.MatchLSN < lastLSN {
+			replicaLag.LagRecords = lastLSN - progress.MatchLSN
+			since := progress.LastAck
+			if timestamp, err := recordTimestamp(shardLog, progress.MatchLSN+1); err == nil {
+				since = timestamp
+			}
+			if !since.IsZero() {
+				replicaLag.LagSeconds = time.Since(since).Seconds()
+			}
+		}
+		lag[serverID] = replicaLag
+	}
+	return lag
+}
+
+// recordTimestamp returns when the first record at or after lsn was logged.
+func recordTimestamp(shardLog *wal.Log, lsn int64) (time.Time, error) {
+	errFound := errors.New("found")
+	var timestamp time.Time
+	err := shardLog.ReadFrom(lsn, func(record wal.Record) error {
+		timestamp = record.Timestamp
+		return errFound
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return time.Time{}, err
+	}
+	if timestamp.IsZero() {
+		return time.Time{}, fmt.Errorf("no WAL record at LSN %d", lsn)
+	}
+	return timestamp, nil
+}
+
+// localServerID returns the ID of this server, or 0 if it has none.
+func localServerID() int {
+	serverID, err := strconv.Atoi(os.Getenv("id"))
+	if err != nil {
+		return 0
+	}
+	return serverID
+}
+
+// getWalLength returns the number of records in the WAL, which is the sum of
+// every shard's last LSN.
+func getWalLength() int {
+	length := 0
+	for _, lsn := range walManager.Positions() {
+		length += int(lsn)
+	}
+	return length
+}
+
+// getShardServers asks the shard manager which servers hold shard and which
+// of them is its primary.
+func getShardServers(shard string) (ShardServersResponse, error) {
+	payload := ShardServersRequest{
+		ShardID: shard,
+	}
+
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return ShardServersResponse{}, fmt.Errorf("Error marshaling JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", SHARD_MANAGER_URL+"/shard_servers", bytes.NewBuffer(payloadData))
+	if err != nil {
+		return ShardServersResponse{}, fmt.Errorf("Error creating request for shard manager: %v", err)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ShardServersResponse{}, fmt.Errorf("Error sending request to shard manager: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ShardServersResponse{}, fmt.Errorf("Error reading response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ShardServersResponse{}, fmt.Errorf("Error from shard manager: %s", strings.TrimSpace(string(body)))
+	}
+
+	var shardServers ShardServersResponse
+	err = json.Unmarshal(body, &shardServers)
+	if err != nil {
+		return ShardServersResponse{}, fmt.Errorf("Error unmarshaling JSON: %v", err)
+	}
+
+	return shardServers, nil
+}
+
+// synReplication proposes a client mutation to the shard's Raft group, which
+// commits it once a majority of the replicas have it and applies it on every
+// replica in the same order. How many replicas the write waits for depends on
+// the shard's replication mode: async writes return as soon as the leader has
+// logged them. epoch is the fencing token the load balancer sent, 0 if none.
+// On any replica but the leader of that epoch it fails with
+// raft.ErrNotLeader. The caller holds the shard's lock.
+func synReplication(shard string, reqBody Requester, epoch int64, key string) (int64, error) {
+	node, err := leaderNode(shard, epoch)
+	if err != nil {
+		return 0, err
+	}
+	// Commits are logged regardless, so that their transaction is resolved
+	// either way.
+	if key != "" && recordsKey(reqBody.GetOp()) && reqBody.GetOp() != WAL_OP_COMMIT {
+		lsn, applied, err := appliedKey(shard, key)
+		if err != nil || applied {
+			return lsn, err
+		}
+	}
+
+	shardServers, err := getShardServers(shard)
+	if err != nil {
+		return 0, err
+	}
+
+	// The coordinator of a transaction relies on its prepare and commit
+	// records surviving a failover, which only a majority guarantees.
+	mode := shardServers.ReplicationMode
+	if mode == REPLICATION_MODE_ASYNC && isTxnOp(reqBody.GetOp()) {
+		mode = REPLICATION_MODE_SEMI_SYNC
+	}
+	waiter := &applyWaiter{failures: make(map[int64]error)}
+	if mode != REPLICATION_MODE_ASYNC {
+		applyWaiters.Store(shard, waiter)
+		defer applyWaiters.CompareAndDelete(shard, waiter)
+	}
+
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("Error marshaling WAL payload: %v", err)
+	}
+	record, err := node.Propose(epoch, reqBody.GetOp(), key, payload)
+	if errors.Is(err, raft.ErrNotLeader) {
+		return 0, fmt.Errorf("%w: shard %s", err, shard)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error writing to WAL: %v", err)
+	}
+
+	// An async write is acknowledged before it is committed or applied, and
+	// is lost if the leader changes before a majority has it.
+	if mode == REPLICATION_MODE_ASYNC {
+		return record.LSN, nil
+	}
+
+	quorum := replicationQuorum(mode, len(shardServers.ServerIDs))
+	timeout := getEnvDuration("REPLICATION_TIMEOUT", REPLICATION_TIMEOUT)
+	if err := node.WaitFor(record, quorum, timeout); err != nil {
+		return 0, fmt.Errorf("Error replicating WAL record %s:%d: %v", shard, record.LSN, err)
+	}
+	if err := waiter.failure(record.LSN); err != nil {
+		return 0, fmt.Errorf("Error committing to database: %v", err)
+	}
+
+	return record.LSN, nil
+}
+
+// leaderNode returns the Raft node of shard if this server leads it in epoch,
+// or in any term if epoch is 0.
+func leaderNode(shard string, epoch int64) (*raft.Node, error) {
+	node, ok := getRaftNode(shard)
+	if !ok {
+		return nil, fmt.Errorf("No WAL for shard %s", shard)
+	}
+	status := node.Status()
+	if status.Role != raft.ROLE_LEADER {
+		return nil, fmt.Errorf("%w: the leader of shard %s is Server%d", raft.ErrNotLeader, shard, status.Leader)
+	}
+	if epoch != 0 && epoch != status.Term {
+		return nil, fmt.Errorf("%w: shard %s is in epoch %d, not %d", raft.ErrNotLeader, shard, status.Term, epoch)
+	}
+	return node, nil
+}
+
+// replicationStatus returns the HTTP status a failed client mutation is
+// answered with.
+func replicationStatus(err error) int {
+	if errors.Is(err, raft.ErrNotLeader) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, errTxnConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func createIdempotencyKeysTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS idempotency_keys (shard TEXT NOT NULL, key TEXT NOT NULL, lsn INTEGER NOT NULL, timestamp INTEGER NOT NULL, PRIMARY KEY (shard, key))")
+	if err != nil {
+		return fmt.Errorf("error creating idempotency_keys table: %w", err)
+	}
+	return nil
+}
+
+// appliedKey returns the LSN of the record that applied the idempotency key
+// to shard, if one has.
+func appliedKey(shard string, key string) (int64, bool, error) {
+	var lsn int64
+	err := db.QueryRow("SELECT lsn FROM idempotency_keys WHERE shard = ? AND key = ?", shard, key).Scan(&lsn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying idempotency_keys: %w", err)
+	}
+	return lsn, true, nil
+}
+
+// getAppliedKeys returns the idempotency keys applied to shard.
+func getAppliedKeys(shard string) ([]AppliedKey, error) {
+	rows, err := db.Query("SELECT key, lsn, timestamp FROM idempotency_keys WHERE shard = ? ORDER BY lsn", shard)
+	if err != nil {
+		return nil, fmt.Errorf("error querying idempotency_keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []AppliedKey{}
+	for rows.Next() {
+		var key AppliedKey
+		var timestamp int64
+		if err := rows.Scan(&key.Key, &key.LSN, &timestamp); err != nil {
+			return nil, fmt.Errorf("error scanning idempotency_keys: %w", err)
+		}
+		key.Timestamp = time.Unix(0, timestamp)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// expireIdempotencyKeys forgets the idempotency keys applied longer than
+// IDEMPOTENCY_WINDOW ago, after which a request carrying one is applied
+// again.
+func expireIdempotencyKeys() error {
+	cutoff := time.Now().Add(-getEnvDuration("IDEMPOTENCY_WINDOW", IDEMPOTENCY_WINDOW))
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE timestamp < ?", cutoff.UnixNano())
+	return err
+}
+
+func isTxnOp(op string) bool {
+	return op == WAL_OP_PREPARE || op == WAL_OP_COMMIT || op == WAL_OP_ABORT
+}
+
+// errTxnConflict rejects a mutation of a Stud_id that a prepared transaction
+// is about to change.
+var errTxnConflict = errors.New("Stud_id is locked by a prepared transaction")
+
+// errInvalidRequest is a request that cannot be applied to any shard.
+var errInvalidRequest = errors.New("invalid request")
+
+// isRequestError reports whether applying a request failed because of the
+// request itself, which every replica fails alike, rather than because of the
+// database, which may succeed when retried.
+func isRequestError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrError, sqlite3.ErrConstraint, sqlite3.ErrMismatch, sqlite3.ErrRange, sqlite3.ErrTooBig:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, errInvalidRequest)
+}
+
+func createPreparedTxnsTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS prepared_txns (shard TEXT NOT NULL, txid TEXT NOT NULL, ops TEXT NOT NULL, PRIMARY KEY (shard, txid))")
+	if err != nil {
+		return fmt.Errorf("error creating prepared_txns table: %w", err)
+	}
+	return nil
+}
+
+// getPreparedTxns returns the transactions prepared on shard.
+func getPreparedTxns(shard string) ([]PreparedTxn, error) {
+	rows, err := db.Query("SELECT txid, ops FROM prepared_txns WHERE shard = ? ORDER BY txid", shard)
+	if err != nil {
+		return nil, fmt.Errorf("error querying prepared_txns: %w", err)
+	}
+	defer rows.Close()
+
+	prepared := []PreparedTxn{}
+	for rows.Next() {
+		var txn PreparedTxn
+		var ops string
+		if err := rows.Scan(&txn.TxID, &ops); err != nil {
+			return nil, fmt.Errorf("error scanning prepared_txns: %w", err)
+		}
+		if err := json.Unmarshal([]byte(ops), &txn.Ops); err != nil {
+			return nil, fmt.Errorf("error unmarshaling operations of transaction %s: %w", txn.TxID, err)
+		}
+		prepared = append(prepared, txn)
+	}
+	return prepared, rows.Err()
+}
+
+// getPreparedTxn returns the transaction txID if it is prepared on shard.
+func getPreparedTxn(shard string, txID string) (PreparedTxn, bool, error) {
+	prepared, err := getPreparedTxns(shard)
+	if err != nil {
+		return PreparedTxn{}, false, err
+	}
+	for _, txn := range prepared {
+		if txn.TxID == txID {
+			return txn, true, nil
+		}
+	}
+	return PreparedTxn{}, false, nil
+}
+
+// checkPrepared fails with errTxnConflict if a transaction prepared on shard
+// touches any of studIDs.
+func checkPrepared(shard string, studIDs []int) error {
+	prepared, err := getPreparedTxns(shard)
+	if err != nil {
+		return err
+	}
+
+	locked := make(map[int]string)
+	for _, txn := range prepared {
+		for _, studID := range txnStudIDs(txn.Ops) {
+			locked[studID] = txn.TxID
+		}
+	}
+	for _, studID := range studIDs {
+		if txID, ok := locked[studID]; ok {
+			return fmt.Errorf("%w: Stud_id %d of shard %s is held by transaction %s", errTxnConflict, studID, shard, txID)
+		}
+	}
+	return nil
+}
+
+// txnStudIDs returns the Stud_ids the operations of a transaction touch.
+func txnStudIDs(ops []TxnOp) []int {
+	studIDs := []int{}
+	for _, op := range ops {
+		if op.Op == WAL_OP_WRITE {
+			studIDs = append(studIDs, rowStudIDs(op.Data)...)
+		} else {
+			studIDs = append(studIDs, op.StudID)
+		}
+	}
+	return studIDs
+}
+
+func rowStudIDs(rows []ShardData) []int {
+	studIDs := make([]int, len(rows))
+	for i, row := range rows {
+		studIDs[i] = row.StudentID
+	}
+	return studIDs
+}
+
+func validateTxnOps(ops []TxnOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("transaction has no operations")
+	}
+	for _, op := range ops {
+		if _, err := txnOpRequest("", op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txnOpRequest returns the request that makes a transaction operation on
+// shard.
+func txnOpRequest(shard string, op TxnOp) (Requester, error) {
+	switch op.Op {
+	case WAL_OP_WRITE:
+		if len(op.Data) == 0 {
+			return nil, fmt.Errorf("%w: write has no data", errInvalidRequest)
+		}
+		return WriteRequest{Shard: shard, Data: op.Data}, nil
+	case WAL_OP_UPDATE:
+		if len(op.Data) != 1 {
+			return nil, fmt.Errorf("%w: update of Stud_id %d needs exactly one row", errInvalidRequest, op.StudID)
+		}
+		return UpdateRequest{Shard: shard, StudID: op.StudID, Data: op.Data[0], Before: op.Before}, nil
+	case WAL_OP_DELETE:
+		return DeleteRequest{Shard: shard, StudID: op.StudID, Before: op.Before}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown transaction operation %q", errInvalidRequest, op.Op)
+	}
+}
+
+// resolvableTxn returns the transaction txID and whether it is prepared on
+// shard, once this server leads shard in epoch and its tables are up to date
+// with every record committed before it was elected.
+func resolvableTxn(shard string, txID string, epoch int64) (PreparedTxn, bool, error) {
+	node, err := leaderNode(shard, epoch)
+	if err != nil {
+		return PreparedTxn{}, false, err
+	}
+	if !waitTermApplied(shard, node, getEnvDuration("REPLICATION_TIMEOUT", REPLICATION_TIMEOUT)) {
+		return PreparedTxn{}, false, fmt.Errorf("%w: Server%d has not applied the records of its term in shard %s", raft.ErrTimeout, localServerID(), shard)
+	}
+	return getPreparedTxn(shard, txID)
+}
+
+// waitTermApplied waits until the leader of shard has applied a record of
+// its own term, after which its tables reflect every record committed before
+// it was elected, and reports whether it did before timeout.
+func waitTermApplied(shard string, node *raft.Node, timeout time.Duration) bool {
+	shardLog, ok := walManager.Get(shard)
+	if !ok {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		applied, changed := node.Applied()
+		if term, ok := shardLog.TermAt(applied); ok && term == node.Status().Term {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func getRaftNode(shard string) (*raft.Node, bool) {
+	node, ok := raftNodes.Load(shard)
+	if !ok {
+		return nil, false
+	}
+	return node.(*raft.Node), true
+}
+
+// startRaftNode starts the Raft node of shard from its WAL, unless it is
+// already running. The replicas of the shard are whichever servers the shard
+// manager maps it to.
+func startRaftNode(shard string) error {
+	if _, ok := raftNodes.Load(shard); ok {
+		return nil
+	}
+
+	shardLog, err := walManager.Log(shard)
+	if err != nil {
+		return err
+	}
+	applied, err := getAppliedLSN(shard)
+	if err != nil {
+		return err
+	}
+
+	node, err := raft.New(raft.Config{
+		ID:        localServerID(),
+		Shard:     shard,
+		Log:       shardLog,
+		Storage:   raftStore,
+		Transport: raftTransport{},
+		Members: func() ([]int, error) {
+			shardServers, err := getShardServers(shard)
+			return shardServers.ServerIDs, err
+		},
+		Apply:   applyCommittedRecord,
+		Applied: applied,
+		OnLeader: func(term int64) {
+			reportLeader(shard, term)
+		},
+		HeartbeatInterval:      getEnvDuration("RAFT_HEARTBEAT_INTERVAL", RAFT_HEARTBEAT_INTERVAL),
+		ElectionTimeout:        getEnvDuration("RAFT_ELECTION_TIMEOUT", RAFT_ELECTION_TIMEOUT),
+		MembersRefreshInterval: getEnvDuration("RAFT_MEMBERSHIP_REFRESH_INTERVAL", RAFT_MEMBERSHIP_REFRESH_INTERVAL),
+		LeaderReportInterval:   getEnvDuration("RAFT_LEADER_REPORT_INTERVAL", RAFT_LEADER_REPORT_INTERVAL),
+		MaxEntries:             getEnvInt("RAFT_MAX_ENTRIES", RAFT_MAX_ENTRIES),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, running := raftNodes.LoadOrStore(shard, node); !running {
+		node.Start()
+	}
+	return nil
+}
+
+// installShard runs fn, which replaces the state of shard outside of Raft,
+// while the shard's Raft node neither appends nor applies records.
+func installShard(shard string, fn func() (int64, error)) error {
+	if node, ok := getRaftNode(shard); ok {
+		return node.Install(fn)
+	}
+	_, err := fn()
+	return err
+}
+
+// fail records why the record at lsn failed to apply.
+func (w *applyWaiter) fail(lsn int64, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.failures[lsn] = err
+}
+
+// failure returns why the record at lsn failed to apply, if it did.
+func (w *applyWaiter) failure(lsn int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.failures[lsn]
+}
+
+// applyCommittedRecord applies a record committed by the shard's Raft group.
+// A record that cannot be decoded halts the shard's Raft node at its LSN for
+// good, as applying the records after it would leave them out of order, and
+// stops the shard's recovery there on startup. A failure of the database
+// stops the shard too, until the record applies on a retry. Records whose request
+// itself cannot be applied are skipped, as every replica skips them alike;
+// the leader hands the error to the write that is waiting on it.
+func applyCommittedRecord(record wal.Record) error {
+	if record.Op == raft.OP_NOOP {
+		return markApplied(record.Shard, record.LSN)
+	}
+
+	request, err := requestFromRecord(record)
+	if err != nil {
+		return fmt.Errorf("%w: malformed WAL record %s:%d: %w", raft.ErrCannotApply, record.Shard, record.LSN, err)
+	}
+	err = applyToShard(db, request, record)
+	if err == nil || !isRequestError(err) {
+		return err
+	}
+
+	log.Printf("Skipping WAL record %s:%d: %v\n", record.Shard, record.LSN, err)
+	if waiter, ok := applyWaiters.Load(record.Shard); ok {
+		waiter.(*applyWaiter).fail(record.LSN, err)
+	}
+	return markApplied(record.Shard, record.LSN)
+}
+
+// markApplied records that shard reflects the WAL up to lsn without changing
+// its rows.
+func markApplied(shard string, lsn int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAppliedLSN(tx, shard, lsn); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reportLeader tells the shard manager that this server leads shard since
+// term, so that the load balancer sends the shard's writes here.
+func reportLeader(shard string, term int64) {
+	payloadData, err := json.Marshal(LeaderReport{
+		ShardID: shard,
+		Server:  localServerID(),
+		Term:    term,
+	})
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v\n", err)
+		return
+	}
+
+	resp, err := http.Post(SHARD_MANAGER_URL+"/leader", "application/json", bytes.NewBuffer(payloadData))
+	if err != nil {
+		log.Printf("Error reporting leader of shard %s: %v\n", shard, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Error reporting leader of shard %s: %s\n", shard, strings.TrimSpace(string(body)))
+	}
+}
+
+// fetchSnapshot takes a snapshot of shard on another replica.
+func fetchSnapshot(shard string, serverID int) (Snapshot, error) {
+	resp, err := http.Get(fmt.Sprintf("http://Server%d:5000/snapshot?shard=%s", serverID, shard))
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("error fetching snapshot from Server%d: %v", serverID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Snapshot{}, fmt.Errorf("error fetching snapshot from Server%d: %s", serverID, strings.TrimSpace(string(body)))
+	}
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("error decoding snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+func newRaftStorage(db *sql.DB) (*raftStorage, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS raft_state (shard TEXT PRIMARY KEY, term INTEGER NOT NULL, voted_for INTEGER NOT NULL, commit_lsn INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		return nil, fmt.Errorf("error creating raft_state table: %w", err)
+	}
+	if err := addColumn(db, "raft_state", "commit_lsn", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	return &raftStorage{db: db}, nil
+}
+
+func (s *raftStorage) LoadState(shard string) (int64, int, error) {
+	var term int64
+	var votedFor int
+	err := s.db.QueryRow("SELECT term, voted_for FROM raft_state WHERE shard = ?", shard).Scan(&term, &votedFor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, raft.NONE, nil
+	}
+	if err != nil {
+		return 0, raft.NONE, fmt.Errorf("error querying raft_state: %w", err)
+	}
+	return term, votedFor, nil
+}
+
+func (s *raftStorage) SaveState(shard string, term int64, votedFor int) error {
+	_, err := s.db.Exec("INSERT INTO raft_state (shard, term, voted_for) VALUES (?, ?, ?) ON CONFLICT(shard) DO UPDATE SET term = excluded.term, voted_for = excluded.voted_for",
+		shard, term, votedFor)
+	if err != nil {
+		return fmt.Errorf("error recording Raft state: %w", err)
+	}
+	return nil
+}
+
+func (s *raftStorage) LoadCommit(shard string) (int64, error) {
+	var lsn int64
+	err := s.db.QueryRow("SELECT commit_lsn FROM raft_state WHERE shard = ?", shard).Scan(&lsn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying raft_state: %w", err)
+	}
+	return lsn, nil
+}
+
+func (s *raftStorage) SaveCommit(shard string, lsn int64) error {
+	_, err := s.db.Exec("INSERT INTO raft_state (shard, term, voted_for, commit_lsn) VALUES (?, 0, ?, ?) ON CONFLICT(shard) DO UPDATE SET commit_lsn = excluded.commit_lsn",
+		shard, raft.NONE, lsn)
+	if err != nil {
+		return fmt.Errorf("error recording commit LSN: %w", err)
+	}
+	return nil
+}
+
+func (raftTransport) RequestVote(peer int, request raft.VoteRequest) (raft.VoteResponse, error) {
+	var response raft.VoteResponse
+	err := sendRaftRPC(peer, "/raft/vote", request, &response, getEnvDuration("RAFT_RPC_TIMEOUT", RAFT_RPC_TIMEOUT))
+	return response, err
+}
+
+func (raftTransport) AppendEntries(peer int, request raft.AppendRequest) (raft.AppendResponse, error) {
+	var response raft.AppendResponse
+	err := sendRaftRPC(peer, "/raft/append", request, &response, getEnvDuration("RAFT_RPC_TIMEOUT", RAFT_RPC_TIMEOUT))
+	return response, err
+}
+
+func (raftTransport) InstallSnapshot(peer int, request raft.SnapshotRequest) (raft.SnapshotResponse, error) {
+	var response raft.SnapshotResponse
+	err := sendRaftRPC(peer, "/raft/snapshot", request, &response, SNAPSHOT_TRANSFER_TIMEOUT)
+	return response, err
+}
+
+// sendRaftRPC posts a Raft RPC to another server and decodes its answer.
+func sendRaftRPC(peer int, route string, request interface{}, response interface{}, timeout time.Duration) error {
+	payloadData, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error marshaling JSON: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://Server%d:5000%s", peer, route), bytes.NewBuffer(payloadData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}